@@ -0,0 +1,270 @@
+package msgio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// ErrQueueFull is returned by an AsyncWriter using OverflowError when its
+// queue is full.
+var ErrQueueFull = errors.New("write queue full")
+
+// ErrDrainTimeout is returned by AsyncWriter.Close when the queue could not
+// be flushed in time.
+var ErrDrainTimeout = errors.New("timed out draining write queue")
+
+// OverflowPolicy decides what an AsyncWriter does with a message when its
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the caller until there is room.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest silently discards the message being written.
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest queued message of the same
+	// priority, or of a lower priority if there is none, to make room.
+	OverflowDropOldest
+	// OverflowError rejects the message with ErrQueueFull.
+	OverflowError
+)
+
+// Priority selects the lane a message is queued in. Messages in a higher
+// lane are always written before messages in a lower one.
+type Priority int
+
+const (
+	PriorityBulk Priority = iota
+	PriorityNormal
+	PriorityControl
+
+	numPriorities = int(PriorityControl) + 1
+)
+
+// AsyncWriter queues messages and writes them to a Writer from a dedicated
+// goroutine, so that callers never wait on a slow destination. Messages are
+// copied into pooled buffers when queued.
+type AsyncWriter struct {
+	W Writer
+
+	policy OverflowPolicy
+	size   int
+
+	lock    sync.Mutex
+	cond    sync.Cond
+	lanes   [numPriorities][][]byte
+	queued  int
+	dropped int
+	closing bool
+	err     error
+	done    chan struct{}
+}
+
+// NewAsyncWriter wraps w with a queue holding up to queueSize messages and
+// starts its writer goroutine.
+func NewAsyncWriter(w Writer, queueSize int, policy OverflowPolicy) *AsyncWriter {
+	if queueSize <= 0 {
+		panic("non-positive queue size")
+	}
+	a := &AsyncWriter{
+		W:      w,
+		policy: policy,
+		size:   queueSize,
+		done:   make(chan struct{}),
+	}
+	a.cond.L = &a.lock
+	go a.loop()
+	return a
+}
+
+func (a *AsyncWriter) Write(msg []byte) (int, error) {
+	err := a.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// WriteMsg queues msg with PriorityNormal.
+func (a *AsyncWriter) WriteMsg(msg []byte) error {
+	return a.WriteMsgPriority(msg, PriorityNormal)
+}
+
+// WriteMsgPriority queues msg in the given priority lane. An error means the
+// message was not queued; a nil error doesn't mean it has been written.
+// Errors from the underlying Writer are reported by later calls and by
+// Close.
+func (a *AsyncWriter) WriteMsgPriority(msg []byte, p Priority) error {
+	if p < 0 || int(p) >= numPriorities {
+		p = PriorityNormal
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for {
+		if a.err != nil {
+			return a.err
+		}
+		if a.closing {
+			return io.ErrClosedPipe
+		}
+		if a.queued < a.size {
+			break
+		}
+		switch a.policy {
+		case OverflowDropNewest:
+			a.dropped++
+			return nil
+		case OverflowDropOldest:
+			if a.dropOldest(p) {
+				continue
+			}
+			a.dropped++
+			return nil
+		case OverflowError:
+			return ErrQueueFull
+		default:
+			a.cond.Wait()
+		}
+	}
+
+	buf := pool.Get(len(msg))
+	copy(buf, msg)
+	a.lanes[p] = append(a.lanes[p], buf)
+	a.queued++
+	a.cond.Broadcast()
+	return nil
+}
+
+// dropOldest discards the oldest message in lane p or a lower one. It must
+// be called with a.lock held.
+func (a *AsyncWriter) dropOldest(p Priority) bool {
+	for ; p >= 0; p-- {
+		lane := a.lanes[p]
+		if len(lane) == 0 {
+			continue
+		}
+		pool.Put(lane[0])
+		lane[0] = nil
+		a.lanes[p] = lane[1:]
+		a.queued--
+		a.dropped++
+		return true
+	}
+	return false
+}
+
+// Dropped returns the number of messages discarded by the overflow policy.
+func (a *AsyncWriter) Dropped() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.dropped
+}
+
+// Len returns the number of queued messages.
+func (a *AsyncWriter) Len() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.queued
+}
+
+// next blocks until a message is queued and pops the highest priority one.
+// It returns false once the writer is closing and the queue is empty.
+func (a *AsyncWriter) next() ([]byte, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for {
+		for p := numPriorities - 1; p >= 0; p-- {
+			lane := a.lanes[p]
+			if len(lane) == 0 {
+				continue
+			}
+			msg := lane[0]
+			lane[0] = nil
+			a.lanes[p] = lane[1:]
+			a.queued--
+			a.cond.Broadcast()
+			return msg, true
+		}
+		if a.closing || a.err != nil {
+			return nil, false
+		}
+		a.cond.Wait()
+	}
+}
+
+func (a *AsyncWriter) loop() {
+	defer close(a.done)
+	for {
+		msg, ok := a.next()
+		if !ok {
+			return
+		}
+		err := a.W.WriteMsg(msg)
+		pool.Put(msg)
+		if err != nil {
+			a.fail(err)
+			return
+		}
+	}
+}
+
+func (a *AsyncWriter) fail(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.err == nil {
+		a.err = err
+	}
+	for p := range a.lanes {
+		for _, msg := range a.lanes[p] {
+			pool.Put(msg)
+		}
+		a.lanes[p] = nil
+	}
+	a.queued = 0
+	a.cond.Broadcast()
+}
+
+// Close stops accepting messages and waits for the queue to drain.
+func (a *AsyncWriter) Close() error {
+	return a.CloseTimeout(0)
+}
+
+// CloseTimeout is like Close but gives up draining after timeout, discarding
+// whatever is still queued and returning ErrDrainTimeout. A timeout of zero
+// waits indefinitely. The underlying Writer is closed afterwards if it is a
+// WriteCloser.
+func (a *AsyncWriter) CloseTimeout(timeout time.Duration) error {
+	a.lock.Lock()
+	a.closing = true
+	a.cond.Broadcast()
+	a.lock.Unlock()
+
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		select {
+		case <-a.done:
+		case <-t.C:
+			a.fail(ErrDrainTimeout)
+		}
+		t.Stop()
+	} else {
+		<-a.done
+	}
+
+	a.lock.Lock()
+	err := a.err
+	a.lock.Unlock()
+
+	if c, ok := a.W.(WriteCloser); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedWriter blocks every write until the gate is opened.
+type gatedWriter struct {
+	gate chan struct{}
+	lock sync.Mutex
+	msgs []string
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{gate: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(msg []byte) (int, error) {
+	return len(msg), w.WriteMsg(msg)
+}
+
+func (w *gatedWriter) WriteMsg(msg []byte) error {
+	<-w.gate
+	w.lock.Lock()
+	w.msgs = append(w.msgs, string(msg))
+	w.lock.Unlock()
+	return nil
+}
+
+func (w *gatedWriter) written() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.msgs...)
+}
+
+// fill queues "blocker", waits for the writer goroutine to pick it up, and
+// then queues msgs.
+func fill(t *testing.T, a *AsyncWriter, msgs ...string) {
+	if err := a.WriteMsg([]byte("blocker")); err != nil {
+		t.Fatal(err)
+	}
+	for a.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, m := range msgs {
+		if err := a.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAsyncWriter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	a := NewAsyncWriter(NewWriter(buf), 10, OverflowBlock)
+	for i := 0; i < 100; i++ {
+		if err := a.WriteMsg([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	for i := 0; i < 100; i++ {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] != byte(i) {
+			t.Fatalf("expected %d, got %d", i, msg[0])
+		}
+	}
+	if err := a.WriteMsg(nil); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, got %v", err)
+	}
+}
+
+func TestAsyncWriterOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy   OverflowPolicy
+		expected []string
+		err      error
+	}{
+		{OverflowDropNewest, []string{"blocker", "a", "b"}, nil},
+		{OverflowDropOldest, []string{"blocker", "b", "c"}, nil},
+		{OverflowError, []string{"blocker", "a", "b"}, ErrQueueFull},
+	} {
+		w := newGatedWriter()
+		a := NewAsyncWriter(w, 2, tc.policy)
+		fill(t, a, "a", "b")
+		if err := a.WriteMsg([]byte("c")); err != tc.err {
+			t.Fatalf("policy %d: expected %v, got %v", tc.policy, tc.err, err)
+		}
+		close(w.gate)
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := w.written()
+		if len(got) != len(tc.expected) {
+			t.Fatalf("policy %d: expected %q, got %q", tc.policy, tc.expected, got)
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] {
+				t.Fatalf("policy %d: expected %q, got %q", tc.policy, tc.expected, got)
+			}
+		}
+	}
+}
+
+func TestAsyncWriterPriority(t *testing.T) {
+	w := newGatedWriter()
+	a := NewAsyncWriter(w, 10, OverflowBlock)
+	fill(t, a, "bulk1")
+	a.WriteMsgPriority([]byte("bulk2"), PriorityBulk)
+	a.WriteMsgPriority([]byte("control"), PriorityControl)
+	close(w.gate)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := w.written()
+	expected := []string{"blocker", "control", "bulk1", "bulk2"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestAsyncWriterBlock(t *testing.T) {
+	w := newGatedWriter()
+	a := NewAsyncWriter(w, 1, OverflowBlock)
+	fill(t, a, "a")
+
+	written := make(chan error)
+	go func() { written <- a.WriteMsg([]byte("b")) }()
+	select {
+	case <-written:
+		t.Fatal("write should block on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(w.gate)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAsyncWriterCloseTimeout(t *testing.T) {
+	w := newGatedWriter()
+	a := NewAsyncWriter(w, 10, OverflowBlock)
+	fill(t, a, "a")
+
+	if err := a.CloseTimeout(10 * time.Millisecond); err != ErrDrainTimeout {
+		t.Fatalf("expected ErrDrainTimeout, got %v", err)
+	}
+	close(w.gate)
+}
@@ -0,0 +1,218 @@
+package msgio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// ErrUnknownFraming is returned by NewAutoReader when no candidate framing
+// can have produced the stream.
+var ErrUnknownFraming = errors.New("unknown framing")
+
+// sniffSize is how much of a stream NewAutoReader looks at.
+const sniffSize = 4096
+
+// sniffShifts is how many misaligned starts NewAutoReader tries.
+const sniffShifts = 8
+
+// NewAutoReader detects the framing of the stream read from r and returns a
+// reader for it, along with the framing, rejecting messages larger than
+// maxSize. A maxSize of zero means the default.
+//
+// The candidates are the hints if any are given, and every registered
+// framing otherwise; a framing that isn't a hint is never returned. Each
+// candidate decodes as many frames as it can from the start of the stream.
+// Candidates that run into an invalid frame, a message larger than maxSize,
+// or garbage that ResyncFraming has to skip are ruled out. Of the others,
+// those that decode complete frames and no empty messages are preferred,
+// then those that decode no empty messages. Empty messages are rare in
+// practice, but are what the zero bytes of a length prefix look like to
+// most other framings.
+//
+// Ties between those that decode complete frames go to the one that fits
+// the stream least well when started a few bytes in, since a framing that
+// decodes anything proves little; then to the one that decodes the most
+// frames, then the most bytes. Other ties go to the one registered first. The built-in framings are
+// registered with those that validate their frames most strictly first,
+// and FixedFraming before VarintFraming. A tight maxSize makes detection
+// more reliable.
+//
+// Some streams are ambiguous: those that start with a message larger than
+// what is sniffed, unless they are FixedFraming or VarintFraming, short
+// COBSFraming streams of messages without zeros, which also decode as
+// VarintFraming, and streams of messages with many newlines, which also
+// decode as LineFraming. Pass hints when the likely framings are known.
+// NewAutoReader blocks until it has read 4KiB or reached the end of the
+// stream, which suits files better than live connections.
+func NewAutoReader(r io.Reader, maxSize int, hints ...Framing) (ReadCloser, Framing, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	br := &bufferedReader{Reader: bufio.NewReaderSize(r, sniffSize), R: r}
+	prefix, err := br.Peek(sniffSize)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	candidates := hints
+	if len(candidates) == 0 {
+		candidates = Framings()
+	}
+	f := sniff(candidates, prefix, maxSize)
+	if f == nil {
+		return nil, nil, ErrUnknownFraming
+	}
+	return f.NewReader(br, maxSize), f, nil
+}
+
+// sniff returns the candidate that fits prefix best, or nil if none fit.
+func sniff(candidates []Framing, prefix []byte, maxSize int) Framing {
+	var (
+		best      Framing
+		bestScore sniffScore
+	)
+	for _, f := range candidates {
+		score, ok := sniffFraming(f, prefix, maxSize)
+		if !ok {
+			continue
+		}
+		for k := 1; k <= sniffShifts && k < len(prefix) && score.rank() == 0; k++ {
+			if s, ok := sniffFraming(f, prefix[k:], maxSize); ok && s.rank() == 0 {
+				score.shifted++
+			}
+		}
+		if best == nil || score.better(bestScore) {
+			best, bestScore = f, score
+		}
+	}
+	return best
+}
+
+// sniffScore is how well the start of a stream decodes with a framing.
+type sniffScore struct {
+	empty    int // empty messages
+	complete int // complete frames
+	covered  int // bytes of complete frames
+	shifted  int // misaligned starts that decode as well
+}
+
+// better reports whether s is a strictly better fit than t. Scores without
+// complete frames or with empty messages tell too little to compare further.
+func (s sniffScore) better(t sniffScore) bool {
+	switch {
+	case s.rank() != t.rank():
+		return s.rank() < t.rank()
+	case s.rank() != 0:
+		return false
+	case s.shifted != t.shifted:
+		return s.shifted < t.shifted
+	case s.complete != t.complete:
+		return s.complete > t.complete
+	default:
+		return s.covered > t.covered
+	}
+}
+
+// rank orders scores, lower is better.
+func (s sniffScore) rank() int {
+	switch {
+	case s.empty > 0:
+		return 2
+	case s.complete == 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sniffFraming scores how well prefix decodes with f, and reports false if
+// it can't be the start of a stream in that framing. A truncated frame at
+// the end of prefix is fine, as prefix may be cut short or the stream may
+// have been.
+func sniffFraming(f Framing, prefix []byte, maxSize int) (sniffScore, bool) {
+	sizer, ok := f.(frameSizer)
+	if !ok {
+		return sniffMessages(f, prefix, maxSize)
+	}
+
+	var score sniffScore
+	for off := 0; off < len(prefix); {
+		var end int
+		p, n, err := sizer.frameSize(bytes.NewReader(prefix[off:]))
+		if err == nil {
+			end = off + p + n
+		}
+		if err == nil && end <= len(prefix) {
+			n, err := sniffMsg(f, prefix[off:end], maxSize)
+			if err != nil {
+				return score, false
+			}
+			if n == 0 {
+				score.empty++
+			}
+			score.complete++
+			score.covered = end
+			off = end
+			continue
+		}
+
+		// the frame is truncated
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return score, false
+		}
+		_, err = sniffMsg(f, prefix[off:], maxSize)
+		return score, err == nil || err == io.EOF || err == io.ErrUnexpectedEOF
+	}
+	return score, true
+}
+
+// sniffMsg decodes the first message in buf and returns its length.
+func sniffMsg(f Framing, buf []byte, maxSize int) (int, error) {
+	r := f.NewReader(bytes.NewReader(buf), maxSize)
+	msg, err := r.ReadMsg()
+	r.ReleaseMsg(msg)
+	// Only skipping garbage counts against a framing: the empty frames
+	// other framings skip are part of the stream.
+	if s, ok := r.(*ResyncReader); ok && s.Skipped() > 0 {
+		return 0, ErrUnknownFraming
+	}
+	return len(msg), err
+}
+
+// sniffMessages is sniffFraming for framings that can't tell the size of a
+// frame.
+func sniffMessages(f Framing, prefix []byte, maxSize int) (sniffScore, bool) {
+	r := f.NewReader(bytes.NewReader(prefix), maxSize)
+	var score sniffScore
+	for {
+		msg, err := r.ReadMsg()
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return score, true
+		default:
+			return score, false
+		}
+		if len(msg) == 0 {
+			score.empty++
+		}
+		score.complete++
+		r.ReleaseMsg(msg)
+	}
+}
+
+// bufferedReader reads through a bufio.Reader, but closes the underlying
+// reader.
+type bufferedReader struct {
+	*bufio.Reader
+	R io.Reader
+}
+
+func (b *bufferedReader) Close() error {
+	if c, ok := b.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
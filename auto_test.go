@@ -0,0 +1,141 @@
+package msgio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestAutoReader(t *testing.T) {
+	samples := map[string][]string{
+		"short":  {"hello", "abc", "log line\n"},
+		"binary": {"\x00\x01\x02\x03", "\xff\xfe", strings.Repeat("\x00", 20)},
+		"large":  {strings.Repeat("x", 10000), "after"},
+	}
+	cases := []struct {
+		framing Framing
+		samples []string
+	}{
+		{FixedFraming, []string{"short", "binary", "large"}},
+		{VarintFraming, []string{"short", "binary", "large"}},
+		{ResyncFraming, []string{"short", "binary"}},
+		{NetstringFraming, []string{"short", "binary"}},
+		// COBS frames of short messages without zeros also decode as uvarint
+		{COBSFraming, []string{"binary"}},
+	}
+	for _, c := range cases {
+		for _, name := range c.samples {
+			f, msgs := c.framing, samples[name]
+			t.Run(f.Name()+"/"+name, func(t *testing.T) {
+				buf := new(bytes.Buffer)
+				w := f.NewWriter(buf)
+				for _, m := range msgs {
+					w.WriteMsg([]byte(m))
+				}
+
+				r, detected, err := NewAutoReader(buf, 1<<20)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if detected != f {
+					t.Fatalf("expected %s, detected %s", f.Name(), detected.Name())
+				}
+				expectMsgs(t, r, msgs...)
+				if _, err := r.ReadMsg(); err != io.EOF {
+					t.Fatalf("expected EOF, got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestAutoReaderLines(t *testing.T) {
+	r, detected, err := NewAutoReader(strings.NewReader("first line\nsecond line\n"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detected != LineFraming {
+		t.Fatalf("expected line framing, detected %s", detected.Name())
+	}
+	expectMsgs(t, r, "first line", "second line")
+}
+
+func TestAutoReaderHints(t *testing.T) {
+	// one empty message is a valid stream in most framings
+	buf := new(bytes.Buffer)
+	NewVarintWriter(buf).WriteMsg(nil)
+
+	_, detected, err := NewAutoReader(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detected == VarintFraming {
+		t.Fatal("expected an ambiguous stream not to be detected as uvarint without hints")
+	}
+	_, detected, err = NewAutoReader(bytes.NewReader(buf.Bytes()), 0, VarintFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detected != VarintFraming {
+		t.Fatalf("expected the hint to win, detected %s", detected.Name())
+	}
+}
+
+func TestAutoReaderCOBS(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewCOBSWriter(buf)
+	var msgs []string
+	for i := 0; i < 500; i++ {
+		msgs = append(msgs, fmt.Sprintf("key%d\x00value%d", i, i*13))
+		w.WriteMsg([]byte(msgs[i]))
+	}
+	data := buf.Bytes()
+
+	// a long stream with zeros in its messages
+	r, detected, err := NewAutoReader(bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detected != COBSFraming {
+		t.Fatalf("expected cobs, detected %s", detected.Name())
+	}
+	expectMsgs(t, r, msgs...)
+
+	// a leading delimiter flushing the decoder is fine
+	flushed := append([]byte{0}, data...)
+	for _, hints := range [][]Framing{nil, {COBSFraming}} {
+		r, detected, err = NewAutoReader(bytes.NewReader(flushed), 0, hints...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detected != COBSFraming {
+			t.Fatalf("expected cobs, detected %s", detected.Name())
+		}
+		expectMsgs(t, r, msgs[:10]...)
+	}
+
+	// hints that don't fit aren't replaced by a framing that does
+	if _, _, err := NewAutoReader(bytes.NewReader(data), 0, NetstringFraming); err != ErrUnknownFraming {
+		t.Fatalf("expected ErrUnknownFraming, got %v", err)
+	}
+}
+
+func TestFramingRegistry(t *testing.T) {
+	for _, f := range Framings() {
+		g, ok := LookupFraming(f.Name())
+		if !ok || g != f {
+			t.Fatalf("expected to find %s", f.Name())
+		}
+	}
+	if _, ok := LookupFraming("nope"); ok {
+		t.Fatal("expected no framing")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a framing twice to panic")
+		}
+	}()
+	RegisterFraming(FixedFraming)
+}
@@ -0,0 +1,91 @@
+package msgio
+
+import (
+	"context"
+	"io"
+)
+
+// ReadChan starts a goroutine that reads messages from r and delivers them
+// on the returned message channel, which holds up to bufSize messages.
+//
+// Each message received from the channel is owned by the receiver, who should
+// hand it back with r.ReleaseMsg once done with it. When reading stops, the
+// message channel is closed, then the error channel receives the error that
+// stopped it (nothing for a clean io.EOF) and is closed.
+func ReadChan(r Reader, bufSize int) (<-chan []byte, <-chan error) {
+	return ReadChanContext(context.Background(), r, bufSize)
+}
+
+// ReadChanContext is like ReadChan but also stops once ctx is done, reporting
+// ctx.Err(). A ReadMsg that is already blocked can't be interrupted; close
+// the underlying reader to unblock it.
+func ReadChanContext(ctx context.Context, r Reader, bufSize int) (<-chan []byte, <-chan error) {
+	msgs := make(chan []byte, bufSize)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(msgs)
+		for {
+			msg, err := r.ReadMsg()
+			if err != nil {
+				if err != io.EOF {
+					errs <- err
+				}
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				r.ReleaseMsg(msg)
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return msgs, errs
+}
+
+// WriteChan starts a goroutine that writes every message sent on the
+// returned message channel to w. Close the message channel to stop it.
+//
+// A message sent on the channel must not be modified until it has been
+// written; the goroutine does not retain it afterwards. Once the goroutine
+// finishes, the error channel receives the first write error, if any, and is
+// closed, so receiving from it also waits for pending writes. After a write
+// error further messages are discarded rather than blocking the sender.
+func WriteChan(w Writer) (chan<- []byte, <-chan error) {
+	return WriteChanContext(context.Background(), w)
+}
+
+// WriteChanContext is like WriteChan but also stops once ctx is done,
+// reporting ctx.Err(). Senders should select on ctx as well, since nothing
+// receives from the message channel afterwards.
+func WriteChanContext(ctx context.Context, w Writer) (chan<- []byte, <-chan error) {
+	msgs := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		var werr error
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					if werr != nil {
+						errs <- werr
+					}
+					return
+				}
+				if werr == nil {
+					werr = w.WriteMsg(msg)
+				}
+			case <-ctx.Done():
+				if werr == nil {
+					werr = ctx.Err()
+				}
+				errs <- werr
+				return
+			}
+		}
+	}()
+	return msgs, errs
+}
@@ -0,0 +1,108 @@
+package msgio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadChan(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := NewWriter(buf)
+	for _, m := range []string{"a", "b", "c"} {
+		if err := w.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(buf)
+	msgs, errs := ReadChan(r, 1)
+	var got []string
+	for msg := range msgs {
+		got = append(got, string(msg))
+		r.ReleaseMsg(msg)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("unexpected messages %q", got)
+	}
+}
+
+func TestReadChanError(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	NewWriter(buf).WriteMsg([]byte("hello"))
+	buf.Truncate(buf.Len() - 1)
+
+	msgs, errs := ReadChan(NewReader(buf), 0)
+	for range msgs {
+		t.Fatal("expected no messages")
+	}
+	if err := <-errs; err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReadChanContext(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		mw := NewWriter(w)
+		for mw.WriteMsg([]byte("x")) == nil {
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, errs := ReadChanContext(ctx, NewReader(r), 0)
+	<-msgs
+	cancel()
+	for range msgs {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWriteChan(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	msgs, errs := WriteChan(NewWriter(buf))
+	for _, m := range []string{"a", "b", "c"} {
+		msgs <- []byte(m)
+	}
+	close(msgs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	for _, m := range []string{"a", "b", "c"} {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Fatalf("expected %q, got %q", m, msg)
+		}
+	}
+}
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestWriteChanError(t *testing.T) {
+	errBoom := errors.New("boom")
+	msgs, errs := WriteChan(NewWriter(errWriter{errBoom}))
+
+	// senders never block after a failed write
+	for i := 0; i < 3; i++ {
+		msgs <- []byte("x")
+	}
+	close(msgs)
+	if err := <-errs; err != errBoom {
+		t.Fatalf("expected boom, got %v", err)
+	}
+}
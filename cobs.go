@@ -0,0 +1,158 @@
+package msgio
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// ErrInvalidCOBS is returned when reading a frame that isn't valid COBS.
+// The frame is dropped and the next read starts at the following delimiter.
+var ErrInvalidCOBS = errors.New("invalid COBS frame")
+
+// COBSFraming is the framing written by NewCOBSWriter.
+var COBSFraming Framing = cobsFraming{}
+
+type cobsFraming struct{}
+
+func (cobsFraming) Name() string { return "cobs" }
+
+func (cobsFraming) NewReader(r io.Reader, maxSize int) ReadCloser {
+	return NewCOBSReaderSize(r, maxSize)
+}
+
+func (cobsFraming) NewWriter(w io.Writer) WriteCloser {
+	return NewCOBSWriter(w)
+}
+
+func (cobsFraming) frameSize(r io.Reader) (int, int, error) {
+	return delimitedFrameSize(r, 0, true)
+}
+
+// cobsMaxEncodedLen returns the largest encoding of an n byte message, not
+// counting the delimiter.
+func cobsMaxEncodedLen(n int) int {
+	return n + n/254 + 1
+}
+
+// cobsEncode encodes msg into dst, which must hold cobsMaxEncodedLen bytes,
+// and returns the encoded length.
+func cobsEncode(dst, msg []byte) int {
+	code, n := 0, 1
+	for _, b := range msg {
+		if b != 0 {
+			dst[n] = b
+			n++
+		}
+		if b == 0 || n-code == 0xff {
+			dst[code] = byte(n - code)
+			code = n
+			n++
+		}
+	}
+	dst[code] = byte(n - code)
+	return n
+}
+
+// cobsDecode decodes buf in place and returns the decoded length.
+func cobsDecode(buf []byte) (int, error) {
+	n := 0
+	for i := 0; i < len(buf); {
+		code := int(buf[i])
+		if code == 0 || i+code > len(buf) {
+			return 0, ErrInvalidCOBS
+		}
+		i++
+		n += copy(buf[n:], buf[i:i+code-1])
+		i += code - 1
+		if code < 0xff && i < len(buf) {
+			buf[n] = 0
+			n++
+		}
+	}
+	return n, nil
+}
+
+// cobsWriter is the underlying type that implements the Writer interface.
+type cobsWriter struct {
+	W io.Writer
+
+	pool *pool.BufferPool
+	lock sync.Mutex
+}
+
+// NewCOBSWriter wraps an io.Writer with a msgio framed writer that encodes
+// every message with consistent overhead byte stuffing and ends it with a
+// zero byte. As zero never appears inside a frame, a reader can always find
+// the start of the next one, however damaged the stream.
+func NewCOBSWriter(w io.Writer) WriteCloser {
+	return NewCOBSWriterWithPool(w, pool.GlobalPool)
+}
+
+// NewCOBSWriterWithPool is the same as NewCOBSWriter but allows one to
+// specify a buffer pool.
+func NewCOBSWriterWithPool(w io.Writer, p *pool.BufferPool) WriteCloser {
+	if p == nil {
+		panic("nil pool")
+	}
+	return &cobsWriter{W: w, pool: p}
+}
+
+func (s *cobsWriter) Write(msg []byte) (int, error) {
+	err := s.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *cobsWriter) WriteMsg(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf := s.pool.Get(cobsMaxEncodedLen(len(msg)) + 1)
+	n := cobsEncode(buf, msg)
+	buf[n] = 0
+	_, err := s.W.Write(buf[:n+1])
+	s.pool.Put(buf)
+
+	return err
+}
+
+func (s *cobsWriter) Close() error {
+	if c, ok := s.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewCOBSReader wraps an io.Reader with a msgio framed reader for frames
+// written by NewCOBSWriter. Empty frames, such as a delimiter sent to flush
+// line noise, are ignored.
+func NewCOBSReader(r io.Reader) ReadCloser {
+	return NewCOBSReaderSize(r, defaultMaxSize)
+}
+
+// NewCOBSReaderSize is equivalent to NewCOBSReader but allows one to
+// specify a max message size.
+func NewCOBSReaderSize(r io.Reader, maxMessageSize int) ReadCloser {
+	return NewCOBSReaderSizeWithPool(r, maxMessageSize, pool.GlobalPool)
+}
+
+// NewCOBSReaderWithPool is the same as NewCOBSReader but allows one to
+// specify a buffer pool.
+func NewCOBSReaderWithPool(r io.Reader, p *pool.BufferPool) ReadCloser {
+	return NewCOBSReaderSizeWithPool(r, defaultMaxSize, p)
+}
+
+// NewCOBSReaderSizeWithPool is the same as NewCOBSReader but allows one to
+// specify a buffer pool and a max message size.
+func NewCOBSReaderSizeWithPool(r io.Reader, maxMessageSize int, p *pool.BufferPool) ReadCloser {
+	s := newDelimitedReader(r, maxMessageSize, p)
+	s.skipEmpty = true
+	s.encodedLen = cobsMaxEncodedLen
+	s.decode = cobsDecode
+	return s
+}
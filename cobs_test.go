@@ -0,0 +1,157 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestCOBSRoundTrip(t *testing.T) {
+	msgs := [][]byte{
+		{},
+		{0},
+		{0, 0},
+		[]byte("hello"),
+		{1, 0, 2, 0},
+		bytes.Repeat([]byte{7}, 253),
+		bytes.Repeat([]byte{7}, 254),
+		bytes.Repeat([]byte{7}, 255),
+		append(bytes.Repeat([]byte{7}, 254), 0),
+		bytes.Repeat([]byte{0}, 300),
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		msg := make([]byte, rng.Intn(2000))
+		for j := range msg {
+			if rng.Intn(4) > 0 {
+				msg[j] = byte(rng.Intn(256))
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewCOBSWriter(buf)
+	for _, m := range msgs {
+		if err := w.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Count(buf.Bytes(), []byte{0}) != len(msgs) {
+		t.Fatal("expected zero bytes only as delimiters")
+	}
+
+	r := NewCOBSReader(buf)
+	for i, m := range msgs {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, m) {
+			t.Fatalf("message %d: expected %x, got %x", i, m, msg)
+		}
+		r.ReleaseMsg(msg)
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestCOBSDroppedBytes(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewCOBSWriter(buf)
+	w.WriteMsg([]byte("first"))
+	w.WriteMsg([]byte("second"))
+	w.WriteMsg([]byte("third"))
+
+	// lose the start of the stream, as when attaching to a live UART
+	data := buf.Bytes()[3:]
+	r := NewCOBSReader(bytes.NewReader(data))
+	if _, err := r.ReadMsg(); err != ErrInvalidCOBS {
+		t.Fatalf("expected ErrInvalidCOBS, got %v", err)
+	}
+	for _, expected := range []string{"second", "third"} {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg)
+		}
+	}
+}
+
+func TestCOBSInvalid(t *testing.T) {
+	// the code byte claims more bytes than the frame holds
+	data := []byte{5, 'a', 0, 0, 3, 'o', 'k', 0}
+	r := NewCOBSReader(bytes.NewReader(data))
+	if _, err := r.ReadMsg(); err != ErrInvalidCOBS {
+		t.Fatalf("expected ErrInvalidCOBS, got %v", err)
+	}
+	msg, err := r.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ok" {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+}
+
+func TestCOBSMaxSize(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewCOBSWriter(buf)
+	w.WriteMsg(bytes.Repeat([]byte("x"), 5000))
+	w.WriteMsg([]byte("1234"))
+	w.WriteMsg([]byte("12345"))
+	w.WriteMsg([]byte("ok"))
+
+	r := NewCOBSReaderSize(buf, 4)
+	if _, err := r.ReadMsg(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	if msg, err := r.ReadMsg(); err != nil || string(msg) != "1234" {
+		t.Fatalf("expected 1234, got %q, %v", msg, err)
+	}
+	if _, err := r.ReadMsg(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	if msg, err := r.ReadMsg(); err != nil || string(msg) != "ok" {
+		t.Fatalf("expected ok, got %q, %v", msg, err)
+	}
+}
+
+func TestCOBSShortBuffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewCOBSWriter(buf)
+	w.WriteMsg([]byte("hello"))
+
+	r := NewCOBSReader(buf)
+	if _, err := r.Read(make([]byte, 2)); err != io.ErrShortBuffer {
+		t.Fatalf("expected ErrShortBuffer, got %v", err)
+	}
+	if n, err := r.NextMsgLen(); err != nil || n != 5 {
+		t.Fatalf("expected length 5, got %d, %v", n, err)
+	}
+	b := make([]byte, 10)
+	n, err := r.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q", b[:n])
+	}
+}
+
+func TestCOBSSkipped(t *testing.T) {
+	// flush delimiters around a frame
+	data := []byte{0, 0, 3, 'o', 'k', 0, 0}
+	r := NewCOBSReader(bytes.NewReader(data))
+	expectMsgs(t, r, "ok")
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if s := r.(interface{ Skipped() int64 }).Skipped(); s != 3 {
+		t.Fatalf("expected 3 bytes skipped, got %d", s)
+	}
+}
@@ -0,0 +1,186 @@
+package msgio
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// delimitedReader reads messages that are encoded so they never contain
+// delim, and end with it. Damaged frames only cost themselves: the next
+// read starts after the following delimiter.
+type delimitedReader struct {
+	R  io.Reader
+	br *bufio.Reader
+
+	delim      byte
+	skipEmpty  bool                      // whether empty frames are ignored
+	encodedLen func(n int) int           // the largest encoding of n bytes
+	decode     func([]byte) (int, error) // decodes a frame in place
+
+	buf     []byte // the encoded frame being read
+	next    []byte // a decoded message not consumed by Read yet
+	skipped atomic.Int64
+	pool    *pool.BufferPool
+	lock    sync.Mutex
+	max     int // the maximal message size (in bytes) this reader handles
+}
+
+func newDelimitedReader(r io.Reader, maxMessageSize int, p *pool.BufferPool) *delimitedReader {
+	if p == nil {
+		panic("nil pool")
+	}
+	return &delimitedReader{
+		R:    r,
+		br:   bufio.NewReader(r),
+		pool: p,
+		max:  maxMessageSize,
+	}
+}
+
+// readFrame reads the next encoded frame into s.buf. Frames whose encoding
+// is too long to decode to max bytes are skipped and reported with
+// ErrMsgTooLarge.
+func (s *delimitedReader) readFrame() error {
+	limit := s.encodedLen(s.max)
+	s.buf = s.buf[:0]
+	tooLarge := false
+	for {
+		chunk, err := s.br.ReadSlice(s.delim)
+		if !tooLarge {
+			s.buf = append(s.buf, chunk...)
+			if len(s.buf) > limit+1 {
+				tooLarge = true
+				s.buf = s.buf[:0]
+			}
+		}
+		switch err {
+		case nil:
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(s.buf) > 0 || tooLarge {
+				return io.ErrUnexpectedEOF
+			}
+			return io.EOF
+		default:
+			return err
+		}
+
+		if tooLarge {
+			return ErrMsgTooLarge
+		}
+		s.buf = s.buf[:len(s.buf)-1] // the delimiter
+		if len(s.buf) > 0 || !s.skipEmpty {
+			return nil
+		}
+		s.skipped.Add(1) // the delimiter
+	}
+}
+
+// Skipped returns the number of bytes skipped so far, that is the
+// delimiters of the empty frames ignored.
+func (s *delimitedReader) Skipped() int64 {
+	return s.skipped.Load()
+}
+
+// nextMsg reads and decodes the next message unless one is pending.
+func (s *delimitedReader) nextMsg() ([]byte, error) {
+	if s.next != nil {
+		return s.next, nil
+	}
+	if err := s.readFrame(); err != nil {
+		return nil, err
+	}
+	n, err := s.decode(s.buf)
+	if err != nil {
+		return nil, err
+	}
+	if n > s.max {
+		return nil, ErrMsgTooLarge
+	}
+	msg := s.pool.Get(n)
+	copy(msg, s.buf[:n])
+	if n == 0 {
+		msg = []byte{}
+	}
+	s.next = msg
+	return msg, nil
+}
+
+func (s *delimitedReader) NextMsgLen() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msg, err := s.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *delimitedReader) Read(buf []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msg, err := s.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	s.next = nil
+	n := copy(buf, msg)
+	s.pool.Put(msg)
+	return n, nil
+}
+
+func (s *delimitedReader) ReadMsg() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msg, err := s.nextMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.next = nil
+	return msg, nil
+}
+
+func (s *delimitedReader) ReleaseMsg(msg []byte) {
+	s.pool.Put(msg)
+}
+
+func (s *delimitedReader) Close() error {
+	if c, ok := s.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// delimitedFrameSize reads up to the next delim. Leading delimiters are
+// counted as the prefix when skipEmpty is set.
+func delimitedFrameSize(r io.Reader, delim byte, skipEmpty bool) (int, int, error) {
+	var (
+		b       [1]byte
+		prefix  int
+		payload int
+	)
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, 0, err
+		}
+		switch {
+		case b[0] != delim:
+			payload++
+		case payload == 0 && skipEmpty:
+			prefix++
+		default:
+			return prefix, payload + 1, nil
+		}
+	}
+}
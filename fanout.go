@@ -0,0 +1,383 @@
+package msgio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// ErrSlowConsumer is reported when a Broadcaster evicts a destination whose
+// queue is full.
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// refBuf is a pooled buffer shared by several readers. It goes back to the
+// pool when the last reference is released.
+type refBuf struct {
+	buf  []byte
+	refs atomic.Int32
+}
+
+func newRefBuf(msg []byte, refs int) *refBuf {
+	rb := &refBuf{buf: pool.Get(len(msg))}
+	copy(rb.buf, msg)
+	rb.refs.Store(int32(refs))
+	return rb
+}
+
+func (rb *refBuf) release() {
+	if rb.refs.Add(-1) == 0 {
+		pool.Put(rb.buf)
+	}
+}
+
+// Broadcaster is a Writer that copies each message to many destination
+// Writers. Every destination has its own queue and goroutine, so one slow
+// destination doesn't hold up the others; a destination whose queue is full
+// or whose write fails is evicted. Each message is copied once, into a
+// pooled buffer shared by all destinations.
+type Broadcaster struct {
+	size int
+
+	// OnEvict, if set, is called with every evicted destination and the
+	// reason. It must be set before the first write.
+	OnEvict func(w Writer, err error)
+
+	lock   sync.Mutex
+	dests  []*dest
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type dest struct {
+	w     Writer
+	queue chan *refBuf
+}
+
+// Broadcast returns a Broadcaster writing to ws, queueing up to queueSize
+// messages per destination.
+func Broadcast(queueSize int, ws ...Writer) *Broadcaster {
+	b := &Broadcaster{size: queueSize}
+	for _, w := range ws {
+		b.Add(w)
+	}
+	return b
+}
+
+// Add adds a destination.
+func (b *Broadcaster) Add(w Writer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
+	d := &dest{w: w, queue: make(chan *refBuf, b.size)}
+	b.dests = append(b.dests, d)
+	b.wg.Add(1)
+	go b.run(d)
+}
+
+// Remove removes a destination after its queued messages have been
+// written. It does not close the Writer.
+func (b *Broadcaster) Remove(w Writer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, d := range b.dests {
+		if d.w == w {
+			b.remove(d)
+			return
+		}
+	}
+}
+
+// remove must be called with b.lock held. It reports whether d was still a
+// destination.
+func (b *Broadcaster) remove(d *dest) bool {
+	for i, o := range b.dests {
+		if o == d {
+			b.dests = append(b.dests[:i], b.dests[i+1:]...)
+			close(d.queue)
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of destinations.
+func (b *Broadcaster) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.dests)
+}
+
+func (b *Broadcaster) evict(d *dest, err error) {
+	b.lock.Lock()
+	removed := b.remove(d)
+	b.lock.Unlock()
+	if removed && b.OnEvict != nil {
+		b.OnEvict(d.w, err)
+	}
+}
+
+func (b *Broadcaster) run(d *dest) {
+	defer b.wg.Done()
+	var err error
+	for rb := range d.queue {
+		if err == nil {
+			err = d.w.WriteMsg(rb.buf)
+			if err != nil {
+				// evicting closes the queue; keep releasing what's
+				// left in it
+				b.evict(d, err)
+			}
+		}
+		rb.release()
+	}
+}
+
+func (b *Broadcaster) Write(msg []byte) (int, error) {
+	err := b.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// WriteMsg queues msg for every destination. It never blocks on a
+// destination; failures are reported through OnEvict.
+func (b *Broadcaster) WriteMsg(msg []byte) error {
+	var evicted []*dest
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return io.ErrClosedPipe
+	}
+	if len(b.dests) > 0 {
+		rb := newRefBuf(msg, len(b.dests))
+		for _, d := range b.dests {
+			select {
+			case d.queue <- rb:
+			default:
+				evicted = append(evicted, d)
+				rb.release()
+			}
+		}
+		for _, d := range evicted {
+			b.remove(d)
+		}
+	}
+	b.lock.Unlock()
+
+	if b.OnEvict != nil {
+		for _, d := range evicted {
+			b.OnEvict(d.w, ErrSlowConsumer)
+		}
+	}
+	return nil
+}
+
+// Close waits for every destination's queue to drain. It does not close the
+// destinations.
+func (b *Broadcaster) Close() error {
+	b.lock.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, d := range b.dests {
+			close(d.queue)
+		}
+		b.dests = nil
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+// SourceError is returned by a Merger when one of its sources fails.
+type SourceError struct {
+	Source int
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("source %d: %s", e.Source, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+type sourcedMsg struct {
+	msg []byte
+	src int
+	err error
+}
+
+// Merger is a ReadCloser interleaving the messages of several Readers in
+// the order they arrive. Messages are handed out in the source's own
+// buffers; ReleaseMsg returns them to the source they came from.
+//
+// A source that fails with anything but io.EOF surfaces its error once, as
+// a *SourceError, and the Merger carries on with the other sources. Once
+// every source is done, reads return io.EOF.
+type Merger struct {
+	sources []Reader
+	msgs    chan sourcedMsg
+	closed  chan struct{}
+	once    sync.Once
+
+	rlock sync.Mutex
+	next  *sourcedMsg
+
+	lock   sync.Mutex
+	owners map[*byte]Reader
+}
+
+// Merge starts reading from rs, buffering up to bufSize messages.
+func Merge(bufSize int, rs ...Reader) *Merger {
+	m := &Merger{
+		sources: rs,
+		msgs:    make(chan sourcedMsg, bufSize),
+		closed:  make(chan struct{}),
+		owners:  make(map[*byte]Reader),
+	}
+	var wg sync.WaitGroup
+	for i, r := range rs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.pump(i, r)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(m.msgs)
+	}()
+	return m
+}
+
+func (m *Merger) pump(i int, r Reader) {
+	for {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case m.msgs <- sourcedMsg{src: i, err: &SourceError{Source: i, Err: err}}:
+				case <-m.closed:
+				}
+			}
+			return
+		}
+		select {
+		case m.msgs <- sourcedMsg{msg: msg, src: i}:
+		case <-m.closed:
+			r.ReleaseMsg(msg)
+			return
+		}
+	}
+}
+
+// recv must be called with m.rlock held.
+func (m *Merger) recv() (sourcedMsg, error) {
+	if m.next != nil {
+		sm := *m.next
+		m.next = nil
+		return sm, nil
+	}
+	select {
+	case sm, ok := <-m.msgs:
+		if !ok {
+			return sm, io.EOF
+		}
+		return sm, sm.err
+	case <-m.closed:
+		return sourcedMsg{}, io.ErrClosedPipe
+	}
+}
+
+// ReadMsgFrom is like ReadMsg but also returns the index of the source the
+// message came from.
+func (m *Merger) ReadMsgFrom() ([]byte, int, error) {
+	m.rlock.Lock()
+	defer m.rlock.Unlock()
+
+	sm, err := m.recv()
+	if err != nil {
+		return nil, sm.src, err
+	}
+	if len(sm.msg) > 0 {
+		m.lock.Lock()
+		m.owners[&sm.msg[0]] = m.sources[sm.src]
+		m.lock.Unlock()
+	}
+	return sm.msg, sm.src, nil
+}
+
+func (m *Merger) ReadMsg() ([]byte, error) {
+	msg, _, err := m.ReadMsgFrom()
+	return msg, err
+}
+
+func (m *Merger) Read(buf []byte) (int, error) {
+	m.rlock.Lock()
+	defer m.rlock.Unlock()
+
+	sm, err := m.recv()
+	if err != nil {
+		return 0, err
+	}
+	if len(sm.msg) > len(buf) {
+		m.next = &sm
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(buf, sm.msg)
+	m.sources[sm.src].ReleaseMsg(sm.msg)
+	return n, nil
+}
+
+func (m *Merger) NextMsgLen() (int, error) {
+	m.rlock.Lock()
+	defer m.rlock.Unlock()
+
+	sm, err := m.recv()
+	if err != nil {
+		return 0, err
+	}
+	m.next = &sm
+	return len(sm.msg), nil
+}
+
+// ReleaseMsg hands msg back to the source it was read from.
+func (m *Merger) ReleaseMsg(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	m.lock.Lock()
+	r, ok := m.owners[&msg[0]]
+	delete(m.owners, &msg[0])
+	m.lock.Unlock()
+	if ok {
+		r.ReleaseMsg(msg)
+	}
+}
+
+// Close stops merging and closes every source that is a ReadCloser.
+func (m *Merger) Close() error {
+	m.once.Do(func() { close(m.closed) })
+
+	var errs []error
+	for _, r := range m.sources {
+		if c, ok := r.(ReadCloser); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return multiErr(errs)
+	}
+	return nil
+}
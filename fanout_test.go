@@ -0,0 +1,156 @@
+package msgio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	bufs := []*bytes.Buffer{new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)}
+	b := Broadcast(100, NewWriter(bufs[0]), NewWriter(bufs[1]), NewWriter(bufs[2]))
+	for i := 0; i < 50; i++ {
+		if err := b.WriteMsg([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, buf := range bufs {
+		r := NewReader(buf)
+		for i := 0; i < 50; i++ {
+			msg, err := r.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg[0] != byte(i) {
+				t.Fatalf("expected %d, got %d", i, msg[0])
+			}
+		}
+	}
+}
+
+func TestBroadcastEviction(t *testing.T) {
+	errBoom := errors.New("boom")
+	slow := newGatedWriter()
+	failing := NewWriter(errWriter{errBoom})
+	good := new(bytes.Buffer)
+	goodW := NewWriter(good)
+
+	var lock sync.Mutex
+	evicted := make(map[Writer]error)
+	b := Broadcast(4)
+	b.OnEvict = func(w Writer, err error) {
+		lock.Lock()
+		evicted[w] = err
+		lock.Unlock()
+	}
+	b.Add(slow)
+	b.Add(failing)
+	b.Add(goodW)
+
+	if err := b.WriteMsg([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	for b.Len() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		if err := b.WriteMsg([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		// let the good writer keep up
+		time.Sleep(time.Millisecond)
+	}
+	close(slow.gate)
+	b.Close()
+
+	if evicted[slow] != ErrSlowConsumer {
+		t.Fatalf("expected slow consumer eviction, got %v", evicted[slow])
+	}
+	if evicted[failing] != errBoom {
+		t.Fatalf("expected failing writer eviction, got %v", evicted[failing])
+	}
+	if _, ok := evicted[goodW]; ok {
+		t.Fatal("good writer should not be evicted")
+	}
+	if good.Len() != 10*(lengthSize+1) {
+		t.Fatalf("expected 10 messages, got %d bytes", good.Len())
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var readers []Reader
+	for i := 0; i < 3; i++ {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		for j := 0; j < 10; j++ {
+			w.WriteMsg([]byte{byte(i), byte(j)})
+		}
+		readers = append(readers, NewReader(buf))
+	}
+
+	m := Merge(4, readers...)
+	next := make([]int, 3)
+	var count int
+	for {
+		msg, src, err := m.ReadMsgFrom()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(msg[0]) != src {
+			t.Fatalf("message from %d attributed to %d", msg[0], src)
+		}
+		if int(msg[1]) != next[src] {
+			t.Fatalf("source %d out of order", src)
+		}
+		next[src]++
+		count++
+		m.ReleaseMsg(msg)
+	}
+	if count != 30 {
+		t.Fatalf("expected 30 messages, got %d", count)
+	}
+}
+
+func TestMergeSourceError(t *testing.T) {
+	good := new(bytes.Buffer)
+	NewWriter(good).WriteMsg([]byte("ok"))
+
+	bad := new(bytes.Buffer)
+	NewWriter(bad).WriteMsg([]byte("truncated"))
+	bad.Truncate(bad.Len() - 1)
+
+	m := Merge(0, NewReader(good), NewReader(bad))
+	var msgs []string
+	var serr *SourceError
+	for {
+		msg, err := m.ReadMsg()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.As(err, &serr) {
+				t.Fatalf("expected a SourceError, got %v", err)
+			}
+			continue
+		}
+		msgs = append(msgs, string(msg))
+	}
+	sort.Strings(msgs)
+	if len(msgs) != 1 || msgs[0] != "ok" {
+		t.Fatalf("unexpected messages %q", msgs)
+	}
+	if serr == nil || serr.Source != 1 || serr.Err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected source error %v", serr)
+	}
+}
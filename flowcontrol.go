@@ -0,0 +1,319 @@
+package msgio
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/multiformats/go-varint"
+)
+
+// ErrWouldBlock is returned by TryWriteMsg when the peer has not granted
+// enough credit to send the message.
+var ErrWouldBlock = errors.New("write would block")
+
+// ErrCreditOverrun is returned when the peer sends more than it was granted.
+var ErrCreditOverrun = errors.New("peer exceeded granted credit")
+
+// ErrBadCredit is returned when the peer sends a malformed credit grant, or
+// grants more credit than can be counted.
+var ErrBadCredit = errors.New("invalid credit grant")
+
+// FlowControl wraps a ReadWriteCloser with a credit based flow control
+// protocol. Both peers must use a FlowControl with the same accounting mode.
+//
+// Each side grants its peer a window of credit up front and grants more as
+// the application reads messages. A writer that runs out of credit blocks
+// in WriteMsg, or gets ErrWouldBlock from TryWriteMsg, until the peer
+// catches up. Incoming frames are read by a background goroutine, which
+// buffers at most one window of unread messages.
+type FlowControl struct {
+	rw     ReadWriteCloser
+	window int
+	bytes  bool // count credit in bytes rather than messages
+	pool   *pool.BufferPool
+
+	wlock sync.Mutex
+
+	lock     sync.Mutex
+	cond     sync.Cond
+	credit   int // what we may still send
+	peerWin  int // the peer's window, that is its first grant, or 0 until then
+	queue    [][]byte
+	queued   int // credit used by queue
+	consumed int // credit read since the last grant
+	err      error
+}
+
+// NewFlowControl wraps rw, allowing the peer to have up to window unread
+// messages in flight.
+func NewFlowControl(rw ReadWriteCloser, window int) *FlowControl {
+	return newFlowControl(rw, window, false)
+}
+
+// NewByteFlowControl is like NewFlowControl but counts credit in payload
+// bytes. Messages larger than the peer's window can never be sent and are
+// rejected with ErrMsgTooLarge.
+func NewByteFlowControl(rw ReadWriteCloser, window int) *FlowControl {
+	return newFlowControl(rw, window, true)
+}
+
+func newFlowControl(rw ReadWriteCloser, window int, bytes bool) *FlowControl {
+	if window <= 0 {
+		panic("non-positive flow control window")
+	}
+	f := &FlowControl{
+		rw:     rw,
+		window: window,
+		bytes:  bytes,
+		pool:   pool.GlobalPool,
+	}
+	f.cond.L = &f.lock
+	go f.readLoop()
+	// Grant the initial window in the background so constructing a
+	// FlowControl never blocks on the peer.
+	go f.grant(window)
+	return f
+}
+
+func (f *FlowControl) cost(msg []byte) int {
+	if f.bytes {
+		return len(msg)
+	}
+	return 1
+}
+
+// Credit returns the credit currently available for writing.
+func (f *FlowControl) Credit() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.credit
+}
+
+func (f *FlowControl) fail(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return
+	}
+	// Messages already received can still be read.
+	f.err = err
+	f.cond.Broadcast()
+}
+
+func (f *FlowControl) writeFrame(typ byte, msg []byte) error {
+	buf := f.pool.Get(len(msg) + 1)
+	buf[0] = typ
+	copy(buf[1:], msg)
+
+	f.wlock.Lock()
+	err := f.rw.WriteMsg(buf)
+	f.wlock.Unlock()
+	f.pool.Put(buf)
+	return err
+}
+
+func (f *FlowControl) grant(n int) {
+	var buf [varint.MaxLenUvarint63]byte
+	l := varint.PutUvarint(buf[:], uint64(n))
+	if err := f.writeFrame(frameCredit, buf[:l]); err != nil {
+		f.fail(err)
+	}
+}
+
+func (f *FlowControl) Write(msg []byte) (int, error) {
+	err := f.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// WriteMsg writes msg, blocking until the peer has granted enough credit.
+func (f *FlowControl) WriteMsg(msg []byte) error {
+	return f.writeMsg(msg, true)
+}
+
+// TryWriteMsg writes msg if the peer has granted enough credit, and returns
+// ErrWouldBlock otherwise.
+func (f *FlowControl) TryWriteMsg(msg []byte) error {
+	return f.writeMsg(msg, false)
+}
+
+func (f *FlowControl) writeMsg(msg []byte, block bool) error {
+	c := f.cost(msg)
+
+	f.lock.Lock()
+	for f.credit < c && f.err == nil {
+		if f.peerWin > 0 && c > f.peerWin {
+			f.lock.Unlock()
+			return ErrMsgTooLarge
+		}
+		if !block {
+			f.lock.Unlock()
+			return ErrWouldBlock
+		}
+		f.cond.Wait()
+	}
+	if f.err != nil {
+		err := f.err
+		f.lock.Unlock()
+		return err
+	}
+	f.credit -= c
+	f.lock.Unlock()
+
+	return f.writeFrame(frameData, msg)
+}
+
+func (f *FlowControl) readLoop() {
+	for {
+		msg, err := f.rw.ReadMsg()
+		if err != nil {
+			f.fail(err)
+			return
+		}
+		if len(msg) == 0 {
+			f.fail(ErrUnknownFrame)
+			return
+		}
+
+		switch msg[0] {
+		case frameData:
+			n := copy(msg, msg[1:])
+			msg = msg[:n]
+			c := f.cost(msg)
+
+			f.lock.Lock()
+			if f.err != nil {
+				f.lock.Unlock()
+				f.rw.ReleaseMsg(msg)
+				return
+			}
+			if f.queued+f.consumed+c > f.window {
+				f.lock.Unlock()
+				f.rw.ReleaseMsg(msg)
+				f.fail(ErrCreditOverrun)
+				return
+			}
+			f.queue = append(f.queue, msg)
+			f.queued += c
+			f.cond.Broadcast()
+			f.lock.Unlock()
+		case frameCredit:
+			n, _, err := varint.FromUvarint(msg[1:])
+			f.rw.ReleaseMsg(msg)
+			f.lock.Lock()
+			if err != nil || n > uint64(math.MaxInt-f.credit) {
+				f.lock.Unlock()
+				f.fail(ErrBadCredit)
+				return
+			}
+			if f.peerWin == 0 {
+				// The first grant is always the whole window: the
+				// peer grants more only once we've sent something.
+				f.peerWin = int(n)
+			}
+			f.credit += int(n)
+			f.cond.Broadcast()
+			f.lock.Unlock()
+		default:
+			f.rw.ReleaseMsg(msg)
+			f.fail(ErrUnknownFrame)
+			return
+		}
+	}
+}
+
+// waitMsg must be called with f.lock held.
+func (f *FlowControl) waitMsg() error {
+	for len(f.queue) == 0 {
+		if f.err != nil {
+			return f.err
+		}
+		f.cond.Wait()
+	}
+	return nil
+}
+
+// pop removes the head of the queue and returns it along with the credit to
+// grant back to the peer, if any. It must be called with f.lock held.
+func (f *FlowControl) pop() ([]byte, int) {
+	msg := f.queue[0]
+	f.queue[0] = nil
+	f.queue = f.queue[1:]
+
+	c := f.cost(msg)
+	f.queued -= c
+	f.consumed += c
+	if f.consumed < max(f.window/2, 1) {
+		return msg, 0
+	}
+	grant := f.consumed
+	f.consumed = 0
+	return msg, grant
+}
+
+func (f *FlowControl) NextMsgLen() (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.waitMsg(); err != nil {
+		return 0, err
+	}
+	return len(f.queue[0]), nil
+}
+
+func (f *FlowControl) Read(buf []byte) (int, error) {
+	f.lock.Lock()
+	if err := f.waitMsg(); err != nil {
+		f.lock.Unlock()
+		return 0, err
+	}
+	if len(f.queue[0]) > len(buf) {
+		f.lock.Unlock()
+		return 0, io.ErrShortBuffer
+	}
+	msg, grant := f.pop()
+	f.lock.Unlock()
+
+	n := copy(buf, msg)
+	f.rw.ReleaseMsg(msg)
+	if grant > 0 {
+		f.grant(grant)
+	}
+	return n, nil
+}
+
+func (f *FlowControl) ReadMsg() ([]byte, error) {
+	f.lock.Lock()
+	if err := f.waitMsg(); err != nil {
+		f.lock.Unlock()
+		return nil, err
+	}
+	msg, grant := f.pop()
+	f.lock.Unlock()
+
+	if grant > 0 {
+		f.grant(grant)
+	}
+	return msg, nil
+}
+
+func (f *FlowControl) ReleaseMsg(msg []byte) {
+	f.rw.ReleaseMsg(msg)
+}
+
+// Close closes the wrapped ReadWriteCloser. Messages not yet read are
+// discarded.
+func (f *FlowControl) Close() error {
+	f.fail(io.ErrClosedPipe)
+	f.lock.Lock()
+	for _, msg := range f.queue {
+		f.rw.ReleaseMsg(msg)
+	}
+	f.queue = nil
+	f.lock.Unlock()
+	return f.rw.Close()
+}
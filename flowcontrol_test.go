@@ -0,0 +1,185 @@
+package msgio
+
+import (
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-varint"
+)
+
+func TestFlowControlReadWrite(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewFlowControl(NewReadWriter(a), 4)
+	fb := NewFlowControl(NewReadWriter(b), 4)
+	defer fa.Close()
+	defer fb.Close()
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := fa.WriteMsg([]byte{byte(i)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		msg, err := fb.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg) != 1 || msg[0] != byte(i) {
+			t.Fatalf("expected %d, got %v", i, msg)
+		}
+		fb.ReleaseMsg(msg)
+	}
+}
+
+func TestFlowControlBackpressure(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewFlowControl(NewReadWriter(a), 2)
+	fb := NewFlowControl(NewReadWriter(b), 2)
+	defer fa.Close()
+	defer fb.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := fa.WriteMsg([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fa.TryWriteMsg([]byte("x")); err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got %v", err)
+	}
+
+	written := make(chan error)
+	go func() { written <- fa.WriteMsg([]byte("y")) }()
+	select {
+	case <-written:
+		t.Fatal("write should block without credit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := fb.ReadMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestByteFlowControl(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewByteFlowControl(NewReadWriter(a), 10)
+	fb := NewByteFlowControl(NewReadWriter(b), 10)
+	defer fa.Close()
+	defer fb.Close()
+
+	if err := fa.WriteMsg(make([]byte, 11)); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	if err := fa.WriteMsg(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fa.TryWriteMsg(make([]byte, 3)); err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got %v", err)
+	}
+	if err := fa.TryWriteMsg(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := fb.Read(buf); err != io.ErrShortBuffer {
+		t.Fatalf("expected short buffer, got %v", err)
+	}
+}
+
+func TestFlowControlMismatchedWindows(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewFlowControl(NewReadWriter(a), 8)
+	fb := NewFlowControl(NewReadWriter(b), 4)
+	defer fa.Close()
+	defer fb.Close()
+
+	for _, dir := range [][2]*FlowControl{{fa, fb}, {fb, fa}} {
+		w, r := dir[0], dir[1]
+		go func() {
+			for i := 0; i < 50; i++ {
+				if err := w.WriteMsg([]byte{byte(i)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		for i := 0; i < 50; i++ {
+			msg, err := r.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg) != 1 || msg[0] != byte(i) {
+				t.Fatalf("expected %d, got %v", i, msg)
+			}
+			r.ReleaseMsg(msg)
+		}
+	}
+}
+
+func TestFlowControlBadCredit(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewFlowControl(NewReadWriter(a), 4)
+	defer fa.Close()
+	peer := NewReadWriter(b)
+
+	go func() {
+		// the initial grant, then one that overflows with it
+		peer.WriteMsg(append([]byte{frameCredit}, varint.ToUvarint(4)...))
+		peer.WriteMsg(append([]byte{frameCredit}, varint.ToUvarint(math.MaxInt)...))
+	}()
+	// drain fa's own grant
+	if msg, err := peer.ReadMsg(); err != nil || msg[0] != frameCredit {
+		t.Fatalf("expected a credit frame, got %v, %v", msg, err)
+	}
+	if _, err := fa.ReadMsg(); err != ErrBadCredit {
+		t.Fatalf("expected ErrBadCredit, got %v", err)
+	}
+}
+
+func TestByteFlowControlMismatchedWindows(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewByteFlowControl(NewReadWriter(a), 8)
+	fb := NewByteFlowControl(NewReadWriter(b), 4)
+	defer fa.Close()
+	defer fb.Close()
+
+	// messages are checked against the peer's window, not our own
+	if err := fa.WriteMsg(make([]byte, 6)); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	go fb.WriteMsg(make([]byte, 6))
+	msg, err := fa.ReadMsg()
+	if err != nil || len(msg) != 6 {
+		t.Fatalf("expected a 6 byte message, got %v, %v", msg, err)
+	}
+}
+
+func TestFlowControlPeerClose(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewFlowControl(NewReadWriter(a), 8)
+	fb := NewFlowControl(NewReadWriter(b), 8)
+	defer fb.Close()
+
+	for _, m := range []string{"one", "two", "three"} {
+		if err := fa.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fa.Close()
+
+	// messages sent before the close are still delivered
+	expectMsgs(t, fb, "one", "two", "three")
+	if _, err := fb.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package msgio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/multiformats/go-varint"
+)
+
+var (
+	// ErrBadFragment is returned when reading a fragment that is malformed
+	// or doesn't fit the message it belongs to. The message is dropped.
+	ErrBadFragment = errors.New("malformed fragment")
+
+	// ErrReassemblyFull is returned when a message can't be reassembled
+	// without going over the memory limit. The message is dropped.
+	ErrReassemblyFull = errors.New("reassembly memory limit reached")
+)
+
+// Every fragment is a frame holding the uvarint id of its message, a flags
+// byte, the uvarint size of the whole message if it is the first fragment,
+// and a slice of the message.
+const (
+	fragFirst = 1 << iota
+	fragLast
+)
+
+// FragmentWriter splits messages into fragments of a bounded size, so that
+// messages written concurrently interleave on the underlying Writer instead
+// of waiting for each other: a small message written while a large one is
+// being sent waits for one fragment at most, not for the whole message.
+// Read the fragments with a Reassembler.
+type FragmentWriter struct {
+	W    Writer
+	size int
+
+	ids  atomic.Uint64
+	lock sync.Mutex // held for every fragment
+}
+
+// NewFragmentWriter returns a FragmentWriter writing fragments of up to
+// fragmentSize bytes of message to w.
+func NewFragmentWriter(w Writer, fragmentSize int) *FragmentWriter {
+	if fragmentSize <= 0 {
+		panic("fragment size must be positive")
+	}
+	return &FragmentWriter{W: w, size: fragmentSize}
+}
+
+func (f *FragmentWriter) Write(msg []byte) (int, error) {
+	err := f.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// WriteMsg writes msg as a sequence of fragments. It is safe to call
+// concurrently, and concurrent messages are interleaved.
+func (f *FragmentWriter) WriteMsg(msg []byte) error {
+	id := f.ids.Add(1)
+	buf := pool.Get(2*varint.MaxLenUvarint63 + 1 + min(len(msg), f.size))
+	defer pool.Put(buf)
+
+	for first := true; first || len(msg) > 0; first = false {
+		n := varint.PutUvarint(buf, id)
+		flags := n
+		buf[flags] = 0
+		n++
+		if first {
+			buf[flags] |= fragFirst
+			n += varint.PutUvarint(buf[n:], uint64(len(msg)))
+		}
+		chunk := msg[:min(len(msg), f.size)]
+		msg = msg[len(chunk):]
+		if len(msg) == 0 {
+			buf[flags] |= fragLast
+		}
+		n += copy(buf[n:], chunk)
+
+		f.lock.Lock()
+		err := f.W.WriteMsg(buf[:n])
+		f.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FragmentWriter) Close() error {
+	if c, ok := f.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Reassembler reads the fragments written by a FragmentWriter and returns
+// whole messages, in the order they are completed.
+//
+// Partial messages are kept in memory up to a limit. A message whose
+// fragments stop arriving for longer than the timeout is dropped, and so
+// are the fragments that follow it.
+type Reassembler struct {
+	R       Reader
+	max     int
+	memory  int
+	timeout time.Duration
+
+	lock    sync.Mutex
+	partial map[uint64]*partialMsg
+	used    int    // bytes held by partial messages
+	next    []byte // a complete message not consumed by Read yet
+	dropped atomic.Int64
+}
+
+type partialMsg struct {
+	buf  []byte
+	n    int
+	last time.Time
+}
+
+// NewReassembler returns a Reassembler reading fragments from r. It
+// rejects messages larger than maxSize, keeps at most maxMemory bytes of
+// partial messages, and drops those that don't progress for timeout. A
+// timeout of zero means partial messages never time out.
+func NewReassembler(r Reader, maxSize, maxMemory int, timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		R:       r,
+		max:     maxSize,
+		memory:  maxMemory,
+		timeout: timeout,
+		partial: make(map[uint64]*partialMsg),
+	}
+}
+
+// Dropped returns the number of partial messages dropped for timing out.
+func (r *Reassembler) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+// Pending returns the number of bytes held by partial messages.
+func (r *Reassembler) Pending() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.used
+}
+
+func (r *Reassembler) drop(id uint64) {
+	p := r.partial[id]
+	r.used -= len(p.buf)
+	pool.Put(p.buf)
+	delete(r.partial, id)
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	if r.timeout <= 0 {
+		return
+	}
+	for id, p := range r.partial {
+		if now.Sub(p.last) > r.timeout {
+			r.drop(id)
+			r.dropped.Add(1)
+		}
+	}
+}
+
+// nextMsg reads fragments until a message is complete, unless one is
+// pending.
+func (r *Reassembler) nextMsg() ([]byte, error) {
+	for r.next == nil {
+		frag, err := r.R.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		err = r.add(frag)
+		r.R.ReleaseMsg(frag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.next, nil
+}
+
+// add adds a fragment, setting r.next if it completes a message.
+func (r *Reassembler) add(frag []byte) error {
+	now := time.Now()
+	r.expire(now)
+
+	id, n, err := varint.FromUvarint(frag)
+	if err != nil || n == len(frag) {
+		return ErrBadFragment
+	}
+	flags := frag[n]
+	frag = frag[n+1:]
+
+	p := r.partial[id]
+	if flags&fragFirst != 0 {
+		if p != nil {
+			r.drop(id)
+			return ErrBadFragment
+		}
+		size, n, err := varint.FromUvarint(frag)
+		if err != nil {
+			return ErrBadFragment
+		}
+		frag = frag[n:]
+		switch {
+		case size > uint64(r.max):
+			return ErrMsgTooLarge
+		case flags&fragLast == 0 && r.used+int(size) > r.memory:
+			return ErrReassemblyFull
+		}
+		p = &partialMsg{buf: pool.Get(int(size))}
+		if p.buf == nil {
+			p.buf = []byte{}
+		}
+		r.partial[id] = p
+		r.used += len(p.buf)
+	} else if p == nil {
+		// the rest of a dropped message
+		return nil
+	}
+
+	if len(frag) > len(p.buf)-p.n {
+		r.drop(id)
+		return ErrBadFragment
+	}
+	p.n += copy(p.buf[p.n:], frag)
+	p.last = now
+	if flags&fragLast == 0 {
+		return nil
+	}
+	if p.n != len(p.buf) {
+		r.drop(id)
+		return ErrBadFragment
+	}
+	r.used -= len(p.buf)
+	delete(r.partial, id)
+	r.next = p.buf
+	return nil
+}
+
+func (r *Reassembler) NextMsgLen() (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (r *Reassembler) Read(buf []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	r.next = nil
+	n := copy(buf, msg)
+	pool.Put(msg)
+	return n, nil
+}
+
+func (r *Reassembler) ReadMsg() ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.nextMsg()
+	if err != nil {
+		return nil, err
+	}
+	r.next = nil
+	return msg, nil
+}
+
+func (r *Reassembler) ReleaseMsg(msg []byte) {
+	pool.Put(msg)
+}
+
+// Close drops partial messages and closes the underlying reader if it is an
+// io.Closer.
+func (r *Reassembler) Close() error {
+	r.lock.Lock()
+	for id := range r.partial {
+		r.drop(id)
+	}
+	r.lock.Unlock()
+
+	if c, ok := r.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package msgio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-varint"
+)
+
+// fragment builds a fragment by hand. size is only written for first
+// fragments.
+func fragment(id uint64, flags byte, size int, data string) []byte {
+	frag := append(varint.ToUvarint(id), flags)
+	if flags&fragFirst != 0 {
+		frag = append(frag, varint.ToUvarint(uint64(size))...)
+	}
+	return append(frag, data...)
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewFragmentWriter(NewVarintWriter(buf), 4)
+	msgs := []string{"", "abc", "abcd", "abcdefghij", strings.Repeat("x", 1000)}
+	for _, msg := range msgs {
+		if err := w.WriteMsg([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReassembler(NewVarintReader(buf), 1024, 1024, 0)
+	expectMsgs(t, r, msgs...)
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestFragmentInterleave(t *testing.T) {
+	a, b := io.Pipe()
+	w := NewFragmentWriter(NewVarintWriter(b), 16)
+	r := NewReassembler(NewVarintReader(a), 1<<20, 1<<20, 0)
+
+	var wg sync.WaitGroup
+	large := strings.Repeat("L", 1<<16)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := large
+			if i > 0 {
+				msg = fmt.Sprint("small", i)
+			}
+			if err := w.WriteMsg([]byte(msg)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		b.Close()
+	}()
+
+	got := map[string]bool{}
+	for {
+		msg, err := r.ReadMsg()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[string(msg)] = true
+		r.ReleaseMsg(msg)
+	}
+	for _, msg := range []string{large, "small1", "small2", "small3"} {
+		if !got[msg] {
+			t.Fatalf("missing message %.10q", msg)
+		}
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	vw := NewVarintWriter(buf)
+	writeFrags := func(frags ...[]byte) {
+		for _, f := range frags {
+			if err := vw.WriteMsg(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeFrags(
+		fragment(1, fragFirst, 100, "a"),          // too large
+		fragment(1, fragLast, 0, "b"),             // ignored
+		fragment(2, fragFirst, 8, "abcd"),         // fits
+		fragment(3, fragFirst, 8, "efgh"),         // over the memory limit
+		fragment(2, fragLast, 0, "efgh"),          // completes 2
+		fragment(4, fragFirst|fragLast, 2, "abc"), // longer than its size
+		fragment(5, fragFirst|fragLast, 2, "ok"),  // complete
+	)
+
+	r := NewReassembler(NewVarintReader(buf), 10, 12, 0)
+	for _, expected := range []error{ErrMsgTooLarge, ErrReassemblyFull} {
+		if _, err := r.ReadMsg(); err != expected {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	}
+	expectMsgs(t, r, "abcdefgh")
+	if _, err := r.ReadMsg(); err != ErrBadFragment {
+		t.Fatalf("expected ErrBadFragment, got %v", err)
+	}
+	expectMsgs(t, r, "ok")
+	if r.Pending() != 0 {
+		t.Fatalf("expected nothing pending, got %d bytes", r.Pending())
+	}
+}
+
+func TestFragmentTimeout(t *testing.T) {
+	a, b := io.Pipe()
+	vw := NewVarintWriter(b)
+	r := NewReassembler(NewVarintReader(a), 100, 100, 10*time.Millisecond)
+
+	go func() {
+		vw.WriteMsg(fragment(1, fragFirst, 8, "abcd"))
+		vw.WriteMsg(fragment(2, fragFirst|fragLast, 2, "ok"))
+		time.Sleep(50 * time.Millisecond)
+		vw.WriteMsg(fragment(3, fragFirst|fragLast, 2, "hi"))
+		vw.WriteMsg(fragment(1, fragLast, 0, "efgh"))
+		vw.WriteMsg(fragment(4, fragFirst|fragLast, 3, "end"))
+		b.Close()
+	}()
+
+	expectMsgs(t, r, "ok")
+	if r.Pending() != 8 {
+		t.Fatalf("expected 8 bytes pending, got %d", r.Pending())
+	}
+	expectMsgs(t, r, "hi", "end")
+	if r.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped message, got %d", r.Dropped())
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("expected nothing pending, got %d bytes", r.Pending())
+	}
+}
+
+func TestFragmentShortBuffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewFragmentWriter(NewVarintWriter(buf), 2)
+	if err := w.WriteMsg([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReassembler(NewVarintReader(buf), 100, 100, 0)
+	if n, err := r.NextMsgLen(); err != nil || n != 5 {
+		t.Fatalf("expected 5, got %d, %v", n, err)
+	}
+	small := make([]byte, 2)
+	if _, err := r.Read(small); err != io.ErrShortBuffer {
+		t.Fatalf("expected ErrShortBuffer, got %v", err)
+	}
+	big := make([]byte, 10)
+	if n, err := r.Read(big); err != nil || string(big[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q, %v", big[:n], err)
+	}
+}
@@ -0,0 +1,125 @@
+package msgio
+
+import (
+	"io"
+	"sync"
+
+	"github.com/multiformats/go-varint"
+)
+
+// Framing is a message framing format: a way of delimiting messages on a
+// byte stream, along with constructors for its readers and writers.
+type Framing interface {
+	// Name identifies the framing.
+	Name() string
+
+	// NewReader returns a Reader for this framing, rejecting messages
+	// larger than maxSize.
+	NewReader(r io.Reader, maxSize int) ReadCloser
+
+	// NewWriter returns a Writer for this framing.
+	NewWriter(w io.Writer) WriteCloser
+}
+
+// frameSizer is implemented by framings whose frame size can be learned
+// from the start of the frame alone, without reading the payload. Framings
+// whose readers read ahead must implement it to be indexed.
+type frameSizer interface {
+	// frameSize reads the start of a frame from r and returns the size of
+	// its prefix and of its payload.
+	frameSize(r io.Reader) (prefix int, payload int, err error)
+}
+
+var (
+	// FixedFraming prefixes every message with its length as a big endian
+	// uint32, as NewReader and NewWriter do.
+	FixedFraming Framing = fixedFraming{}
+
+	// VarintFraming prefixes every message with its length as a uvarint,
+	// as NewVarintReader and NewVarintWriter do.
+	VarintFraming Framing = varintFraming{}
+)
+
+type fixedFraming struct{}
+
+func (fixedFraming) Name() string { return "uint32" }
+
+func (fixedFraming) NewReader(r io.Reader, maxSize int) ReadCloser {
+	return NewReaderSize(r, maxSize)
+}
+
+func (fixedFraming) NewWriter(w io.Writer) WriteCloser {
+	return NewWriter(w)
+}
+
+func (fixedFraming) frameSize(r io.Reader) (int, int, error) {
+	n, err := ReadLen(r, nil)
+	return lengthSize, n, err
+}
+
+type varintFraming struct{}
+
+func (varintFraming) Name() string { return "uvarint" }
+
+func (varintFraming) NewReader(r io.Reader, maxSize int) ReadCloser {
+	return NewVarintReaderSize(r, maxSize)
+}
+
+func (varintFraming) NewWriter(w io.Writer) WriteCloser {
+	return NewVarintWriter(w)
+}
+
+func (varintFraming) frameSize(r io.Reader) (int, int, error) {
+	n, err := varint.ReadUvarint(&simpleByteReader{R: r})
+	if err != nil {
+		return 0, 0, err
+	}
+	return varint.UvarintSize(n), int(n), nil
+}
+
+var (
+	framingsLock sync.RWMutex
+	framings     []Framing
+)
+
+func init() {
+	// NewAutoReader prefers the framings registered first, so the ones that
+	// validate frames most strictly come first.
+	for _, f := range []Framing{ResyncFraming, NetstringFraming, FixedFraming, VarintFraming, COBSFraming, LineFraming} {
+		RegisterFraming(f)
+	}
+}
+
+// RegisterFraming makes a framing known by its name, for LookupFraming and
+// NewAutoReader. It panics if a framing of the same name is registered
+// already.
+func RegisterFraming(f Framing) {
+	framingsLock.Lock()
+	defer framingsLock.Unlock()
+	for _, g := range framings {
+		if g.Name() == f.Name() {
+			panic("msgio: framing " + f.Name() + " registered twice")
+		}
+	}
+	framings = append(framings, f)
+}
+
+// LookupFraming returns the registered framing with the given name.
+func LookupFraming(name string) (Framing, bool) {
+	framingsLock.RLock()
+	defer framingsLock.RUnlock()
+	for _, f := range framings {
+		if f.Name() == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Framings returns the registered framings in the order they were
+// registered, starting with the ones built in.
+func Framings() []Framing {
+	framingsLock.RLock()
+	defer framingsLock.RUnlock()
+	return append([]Framing(nil), framings...)
+}
@@ -0,0 +1,221 @@
+// Package headers carries key/value metadata, such as trace ids, content
+// types or tenancy tags, in front of message payloads.
+//
+// Headers and payload travel in a single frame: a uvarint count of header
+// fields, each field as a uvarint length prefixed key and value, and the
+// payload in the rest of the frame.
+package headers
+
+import (
+	"errors"
+	"sort"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-varint"
+)
+
+var (
+	// ErrTooManyHeaders is returned when a message has more header fields
+	// than allowed.
+	ErrTooManyHeaders = errors.New("headers: too many header fields")
+
+	// ErrHeadersTooLarge is returned when the encoded headers of a message
+	// are larger than allowed.
+	ErrHeadersTooLarge = errors.New("headers: headers too large")
+
+	// ErrMalformed is returned when reading a message whose headers can't be
+	// decoded.
+	ErrMalformed = errors.New("headers: malformed headers")
+)
+
+const (
+	// DefaultMaxCount is the default limit on header fields per message.
+	DefaultMaxCount = 64
+
+	// DefaultMaxSize is the default limit on the encoded size of the
+	// headers of a message.
+	DefaultMaxSize = 16 * 1024
+)
+
+// Header holds the header fields of a message. Unlike HTTP headers, keys
+// are case sensitive. A key with several values takes one field per value.
+type Header map[string][]string
+
+// Add adds value to the values of key.
+func (h Header) Add(key, value string) {
+	h[key] = append(h[key], value)
+}
+
+// Set replaces the values of key with value.
+func (h Header) Set(key, value string) {
+	h[key] = []string{value}
+}
+
+// Get returns the first value of key, or "" if it has none.
+func (h Header) Get(key string) string {
+	if v := h[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Del removes key.
+func (h Header) Del(key string) {
+	delete(h, key)
+}
+
+// Writer writes messages with headers to a msgio.Writer.
+type Writer struct {
+	W msgio.Writer
+
+	// MaxCount and MaxSize limit the number of header fields and their
+	// encoded size. Writing headers beyond them fails.
+	MaxCount int
+	MaxSize  int
+}
+
+// NewWriter returns a Writer on w with the default limits.
+func NewWriter(w msgio.Writer) *Writer {
+	return &Writer{W: w, MaxCount: DefaultMaxCount, MaxSize: DefaultMaxSize}
+}
+
+// WriteMsgWithHeaders writes payload with the header h, which may be nil.
+// Fields are written sorted by key.
+func (w *Writer) WriteMsgWithHeaders(h Header, payload []byte) error {
+	keys := make([]string, 0, len(h))
+	count, size := 0, 0
+	for k, vs := range h {
+		keys = append(keys, k)
+		for _, v := range vs {
+			count++
+			size += varint.UvarintSize(uint64(len(k))) + len(k) + varint.UvarintSize(uint64(len(v))) + len(v)
+		}
+	}
+	size += varint.UvarintSize(uint64(count))
+	if count > w.MaxCount {
+		return ErrTooManyHeaders
+	}
+	if size > w.MaxSize {
+		return ErrHeadersTooLarge
+	}
+	sort.Strings(keys)
+
+	buf := pool.Get(size + len(payload))
+	defer pool.Put(buf)
+	n := varint.PutUvarint(buf, uint64(count))
+	for _, k := range keys {
+		for _, v := range h[k] {
+			n += varint.PutUvarint(buf[n:], uint64(len(k)))
+			n += copy(buf[n:], k)
+			n += varint.PutUvarint(buf[n:], uint64(len(v)))
+			n += copy(buf[n:], v)
+		}
+	}
+	copy(buf[n:], payload)
+	return w.W.WriteMsg(buf)
+}
+
+// Reader reads messages with headers from a msgio.Reader.
+type Reader struct {
+	R msgio.Reader
+
+	// MaxCount and MaxSize limit the number of header fields and their
+	// encoded size. Messages beyond them are dropped with an error.
+	MaxCount int
+	MaxSize  int
+}
+
+// NewReader returns a Reader on r with the default limits.
+func NewReader(r msgio.Reader) *Reader {
+	return &Reader{R: r, MaxCount: DefaultMaxCount, MaxSize: DefaultMaxSize}
+}
+
+// ReadMsgWithHeaders reads a message and returns its header and payload.
+// The header is nil if the message has none. The payload is in a pooled
+// buffer, which may be handed back with ReleaseMsg.
+func (r *Reader) ReadMsgWithHeaders() (Header, []byte, error) {
+	msg, err := r.R.ReadMsg()
+	if err != nil {
+		return nil, nil, err
+	}
+	h, n, err := r.decode(msg)
+	if err != nil {
+		r.R.ReleaseMsg(msg)
+		return nil, nil, err
+	}
+
+	// Move the payload to the start of the buffer so it can be released as
+	// is.
+	if len(msg) == n {
+		r.R.ReleaseMsg(msg)
+		return h, nil, nil
+	}
+	return h, msg[:copy(msg, msg[n:])], nil
+}
+
+// decode decodes the headers at the start of msg and returns them, along
+// with their encoded size.
+func (r *Reader) decode(msg []byte) (Header, int, error) {
+	limit := min(len(msg), r.MaxSize)
+	count, n, err := varint.FromUvarint(msg[:limit])
+	if err != nil {
+		if limit < len(msg) {
+			return nil, 0, ErrHeadersTooLarge
+		}
+		return nil, 0, ErrMalformed
+	}
+	if count > uint64(r.MaxCount) {
+		return nil, 0, ErrTooManyHeaders
+	}
+	if count == 0 {
+		return nil, n, nil
+	}
+
+	field := func() (string, error) {
+		l, m, err := varint.FromUvarint(msg[n:limit])
+		if err == nil && uint64(limit-n-m) < l {
+			err = ErrMalformed
+		}
+		if err != nil {
+			if limit < len(msg) {
+				return "", ErrHeadersTooLarge
+			}
+			return "", ErrMalformed
+		}
+		n += m
+		s := string(msg[n : n+int(l)])
+		n += int(l)
+		return s, nil
+	}
+	h := make(Header, count)
+	for i := uint64(0); i < count; i++ {
+		k, err := field()
+		if err != nil {
+			return nil, 0, err
+		}
+		v, err := field()
+		if err != nil {
+			return nil, 0, err
+		}
+		h.Add(k, v)
+	}
+	return h, n, nil
+}
+
+// ReleaseMsg signals a payload returned by ReadMsgWithHeaders can be reused.
+func (r *Reader) ReleaseMsg(msg []byte) {
+	r.R.ReleaseMsg(msg)
+}
+
+// WriteMsgWithHeaders writes payload with the header h to w, with the
+// default limits.
+func WriteMsgWithHeaders(w msgio.Writer, h Header, payload []byte) error {
+	return NewWriter(w).WriteMsgWithHeaders(h, payload)
+}
+
+// ReadMsgWithHeaders reads a message with headers from r, with the default
+// limits. The payload may be handed back with r.ReleaseMsg.
+func ReadMsgWithHeaders(r msgio.Reader) (Header, []byte, error) {
+	return NewReader(r).ReadMsgWithHeaders()
+}
@@ -0,0 +1,110 @@
+package headers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+func TestRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := msgio.NewWriter(buf)
+	h := Header{}
+	h.Set("trace-id", "4bf92f3577b34da6")
+	h.Set("content-type", "application/protobuf")
+	h.Add("tag", "tenant=a")
+	h.Add("tag", "region=eu")
+	if err := WriteMsgWithHeaders(w, h, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMsgWithHeaders(w, nil, []byte("bare")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMsgWithHeaders(w, h, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := msgio.NewReader(buf)
+	got, payload, err := ReadMsgWithHeaders(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "payload" {
+		t.Fatalf("expected payload, got %q", payload)
+	}
+	r.ReleaseMsg(payload)
+	if got.Get("trace-id") != "4bf92f3577b34da6" || got.Get("content-type") != "application/protobuf" {
+		t.Fatalf("unexpected headers %v", got)
+	}
+	if tags := got["tag"]; len(tags) != 2 || tags[0] != "tenant=a" || tags[1] != "region=eu" {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+
+	got, payload, err = ReadMsgWithHeaders(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil || string(payload) != "bare" {
+		t.Fatalf("expected no headers and bare, got %v and %q", got, payload)
+	}
+
+	got, payload, err = ReadMsgWithHeaders(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || payload != nil {
+		t.Fatalf("expected headers only, got %v and %q", got, payload)
+	}
+}
+
+func TestBareOverhead(t *testing.T) {
+	buf := new(bytes.Buffer)
+	WriteMsgWithHeaders(msgio.NewVarintWriter(buf), nil, []byte("x"))
+	if !bytes.Equal(buf.Bytes(), []byte{2, 0, 'x'}) {
+		t.Fatalf("unexpected encoding %x", buf.Bytes())
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+	w := NewWriter(msgio.NewWriter(new(bytes.Buffer)))
+	w.MaxCount = 2
+	h := Header{"a": {"1", "2", "3"}}
+	if err := w.WriteMsgWithHeaders(h, nil); err != ErrTooManyHeaders {
+		t.Fatalf("expected ErrTooManyHeaders, got %v", err)
+	}
+	w.MaxSize = 16
+	h = Header{"a": {strings.Repeat("x", 20)}}
+	if err := w.WriteMsgWithHeaders(h, nil); err != ErrHeadersTooLarge {
+		t.Fatalf("expected ErrHeadersTooLarge, got %v", err)
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	mw := msgio.NewWriter(buf)
+	WriteMsgWithHeaders(mw, Header{"a": {"1", "2", "3"}}, nil)
+	WriteMsgWithHeaders(mw, Header{"a": {strings.Repeat("x", 100)}}, []byte("payload"))
+	mw.WriteMsg([]byte{2, 1, 'k'})
+	WriteMsgWithHeaders(mw, Header{"ok": {"yes"}}, nil)
+
+	r := NewReader(msgio.NewReader(buf))
+	r.MaxCount, r.MaxSize = 2, 32
+	if _, _, err := r.ReadMsgWithHeaders(); err != ErrTooManyHeaders {
+		t.Fatalf("expected ErrTooManyHeaders, got %v", err)
+	}
+	if _, _, err := r.ReadMsgWithHeaders(); err != ErrHeadersTooLarge {
+		t.Fatalf("expected ErrHeadersTooLarge, got %v", err)
+	}
+	if _, _, err := r.ReadMsgWithHeaders(); err != ErrMalformed {
+		t.Fatalf("expected ErrMalformed, got %v", err)
+	}
+	h, _, err := r.ReadMsgWithHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("ok") != "yes" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+}
@@ -0,0 +1,365 @@
+package msgio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// ErrBadIndex is returned when loading an index that is corrupt or doesn't
+// match the data it is loaded for.
+var ErrBadIndex = errors.New("invalid or stale frame index")
+
+// ErrIndexOutOfRange is returned when reading a frame past the end of an
+// IndexedReader.
+var ErrIndexOutOfRange = errors.New("frame index out of range")
+
+const indexMagic = "msgioidx"
+
+const indexVersion = 2
+
+// indexHeaderSize is the size of the index header: the magic, the version,
+// the data size, the frame count and the length of the framing name that
+// follows it.
+const indexHeaderSize = len(indexMagic) + 1 + 8 + 8 + 2
+
+// IndexSuffix is appended to a file's path to name its sidecar index.
+const IndexSuffix = ".idx"
+
+// IndexedReader gives random access to the frames of a recorded stream. It
+// also implements ReadCloser, reading frames sequentially from a cursor
+// that Seek moves.
+//
+// Only complete frames are indexed: a truncated frame at the end of the
+// data is ignored.
+type IndexedReader struct {
+	r       io.ReaderAt
+	size    int64
+	framing Framing
+	offsets []int64 // offsets of every frame
+
+	// rlock keeps Close from unmapping the file under a read.
+	rlock  sync.RWMutex
+	closer func() error
+	closed bool
+
+	lock sync.Mutex
+	next int
+}
+
+// NewIndexedReader indexes the frames in the first size bytes of r by
+// scanning them. For framings that prefix the length, such as FixedFraming
+// and VarintFraming, only the prefixes are read.
+func NewIndexedReader(r io.ReaderAt, size int64, f Framing) (*IndexedReader, error) {
+	ir := &IndexedReader{r: r, size: size, framing: f}
+	if err := ir.scan(); err != nil {
+		return nil, err
+	}
+	return ir, nil
+}
+
+// LoadIndexedReader is like NewIndexedReader, but loads the frame offsets
+// from an index previously written with WriteIndex instead of scanning.
+func LoadIndexedReader(r io.ReaderAt, size int64, f Framing, index io.Reader) (*IndexedReader, error) {
+	ir := &IndexedReader{r: r, size: size, framing: f}
+	if err := ir.loadIndex(index); err != nil {
+		return nil, err
+	}
+	return ir, nil
+}
+
+// OpenIndexedFile opens a recorded file for random access. On Linux the
+// file is memory mapped. If a valid sidecar index exists at
+// path+IndexSuffix it is loaded; otherwise the file is scanned and the
+// index is written out for next time, if possible.
+func OpenIndexedFile(path string, f Framing) (*IndexedReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r, closer, err := mmapFile(file, st.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if idx, err := os.Open(path + IndexSuffix); err == nil {
+		ir, err := LoadIndexedReader(r, st.Size(), f, bufio.NewReader(idx))
+		idx.Close()
+		if err == nil {
+			ir.closer = closer
+			return ir, nil
+		}
+	}
+
+	ir, err := NewIndexedReader(r, st.Size(), f)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	ir.closer = closer
+
+	// The index is only a cache, failing to save it isn't fatal.
+	if idx, err := os.Create(path + IndexSuffix); err == nil {
+		w := bufio.NewWriter(idx)
+		err = ir.WriteIndex(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if cerr := idx.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path + IndexSuffix)
+		}
+	}
+	return ir, nil
+}
+
+// countingReader reads sequentially from an io.ReaderAt and counts the
+// bytes read.
+type countingReader struct {
+	r   io.ReaderAt
+	off int64
+	end int64
+	n   int64
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	if c.off+c.n >= c.end {
+		return 0, io.EOF
+	}
+	if rem := c.end - c.off - c.n; int64(len(buf)) > rem {
+		buf = buf[:rem]
+	}
+	n, err := c.r.ReadAt(buf, c.off+c.n)
+	c.n += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (ir *IndexedReader) maxSize() int {
+	return int(min(ir.size, math.MaxInt32))
+}
+
+func (ir *IndexedReader) scan() error {
+	sizer, fast := ir.framing.(frameSizer)
+	cr := &countingReader{r: ir.r, end: ir.size}
+	for cr.off < ir.size {
+		cr.n = 0
+		var end int64
+		if fast {
+			prefix, payload, err := sizer.frameSize(cr)
+			if err != nil {
+				break
+			}
+			end = cr.off + int64(prefix) + int64(payload)
+		} else {
+			fr := ir.framing.NewReader(cr, ir.maxSize())
+			msg, err := fr.ReadMsg()
+			fr.ReleaseMsg(msg)
+			if err != nil {
+				break
+			}
+			end = cr.off + cr.n
+		}
+		if end > ir.size || end <= cr.off {
+			break
+		}
+		ir.offsets = append(ir.offsets, cr.off)
+		cr.off = end
+	}
+	return nil
+}
+
+// WriteIndex writes the frame offsets so they can be loaded again with
+// LoadIndexedReader. The index records the name of the framing, and only
+// loads for the same framing.
+func (ir *IndexedReader) WriteIndex(w io.Writer) error {
+	name := ir.framing.Name()
+	var hdr [indexHeaderSize]byte
+	copy(hdr[:], indexMagic)
+	hdr[len(indexMagic)] = indexVersion
+	binary.BigEndian.PutUint64(hdr[len(indexMagic)+1:], uint64(ir.size))
+	binary.BigEndian.PutUint64(hdr[len(indexMagic)+9:], uint64(len(ir.offsets)))
+	// A name too long for its length never matches when loading.
+	binary.BigEndian.PutUint16(hdr[len(indexMagic)+17:], uint16(len(name)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, name); err != nil {
+		return err
+	}
+
+	var entry [8]byte
+	for _, off := range ir.offsets {
+		binary.BigEndian.PutUint64(entry[:], uint64(off))
+		if _, err := w.Write(entry[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ir *IndexedReader) loadIndex(r io.Reader) error {
+	var hdr [indexHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return ErrBadIndex
+	}
+	if string(hdr[:len(indexMagic)]) != indexMagic || hdr[len(indexMagic)] != indexVersion {
+		return ErrBadIndex
+	}
+	if int64(binary.BigEndian.Uint64(hdr[len(indexMagic)+1:])) != ir.size {
+		return ErrBadIndex
+	}
+	name := make([]byte, binary.BigEndian.Uint16(hdr[len(indexMagic)+17:]))
+	if _, err := io.ReadFull(r, name); err != nil || string(name) != ir.framing.Name() {
+		return ErrBadIndex
+	}
+	count := binary.BigEndian.Uint64(hdr[len(indexMagic)+9:])
+	if count > uint64(ir.size) {
+		return ErrBadIndex
+	}
+
+	// Grow the offsets as entries are read rather than trusting count, so
+	// that a corrupt index can't make us allocate more than it holds.
+	offsets := make([]int64, 0, min(count, 4096))
+	var entry [8]byte
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(r, entry[:]); err != nil {
+			return ErrBadIndex
+		}
+		off := int64(binary.BigEndian.Uint64(entry[:]))
+		if off < 0 || off >= ir.size || (i > 0 && off <= offsets[i-1]) {
+			return ErrBadIndex
+		}
+		offsets = append(offsets, off)
+	}
+	ir.offsets = offsets
+	return nil
+}
+
+// Len returns the number of frames.
+func (ir *IndexedReader) Len() int {
+	return len(ir.offsets)
+}
+
+// Offset returns the byte offset of frame i.
+func (ir *IndexedReader) Offset(i int) int64 {
+	return ir.offsets[i]
+}
+
+// ReadAt returns the payload of frame i in a pooled buffer, which may be
+// handed back with ReleaseMsg. It is safe to call concurrently.
+func (ir *IndexedReader) ReadAt(i int) ([]byte, error) {
+	if i < 0 || i >= len(ir.offsets) {
+		return nil, ErrIndexOutOfRange
+	}
+	ir.rlock.RLock()
+	defer ir.rlock.RUnlock()
+	if ir.closed {
+		return nil, os.ErrClosed
+	}
+	end := ir.size
+	if i+1 < len(ir.offsets) {
+		end = ir.offsets[i+1]
+	}
+	fr := ir.framing.NewReader(&countingReader{r: ir.r, off: ir.offsets[i], end: end}, ir.maxSize())
+	msg, err := fr.ReadMsg()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return msg, err
+}
+
+// Seek moves the cursor used by ReadMsg to frame i. Seeking to Len() is
+// allowed and makes the next read return io.EOF.
+func (ir *IndexedReader) Seek(i int) error {
+	if i < 0 || i > len(ir.offsets) {
+		return ErrIndexOutOfRange
+	}
+	ir.lock.Lock()
+	ir.next = i
+	ir.lock.Unlock()
+	return nil
+}
+
+func (ir *IndexedReader) ReadMsg() ([]byte, error) {
+	ir.lock.Lock()
+	defer ir.lock.Unlock()
+
+	if ir.next >= len(ir.offsets) {
+		return nil, io.EOF
+	}
+	msg, err := ir.ReadAt(ir.next)
+	if err != nil {
+		return nil, err
+	}
+	ir.next++
+	return msg, nil
+}
+
+func (ir *IndexedReader) Read(buf []byte) (int, error) {
+	ir.lock.Lock()
+	defer ir.lock.Unlock()
+
+	if ir.next >= len(ir.offsets) {
+		return 0, io.EOF
+	}
+	msg, err := ir.ReadAt(ir.next)
+	if err != nil {
+		return 0, err
+	}
+	defer ir.ReleaseMsg(msg)
+	if len(msg) > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	ir.next++
+	return copy(buf, msg), nil
+}
+
+func (ir *IndexedReader) NextMsgLen() (int, error) {
+	ir.lock.Lock()
+	defer ir.lock.Unlock()
+
+	if ir.next >= len(ir.offsets) {
+		return 0, io.EOF
+	}
+	msg, err := ir.ReadAt(ir.next)
+	if err != nil {
+		return 0, err
+	}
+	defer ir.ReleaseMsg(msg)
+	return len(msg), nil
+}
+
+func (ir *IndexedReader) ReleaseMsg(msg []byte) {
+	pool.Put(msg)
+}
+
+// Close releases the file opened by OpenIndexedFile; readers created from
+// an io.ReaderAt don't own it. Reads fail with os.ErrClosed afterwards.
+func (ir *IndexedReader) Close() error {
+	ir.rlock.Lock()
+	defer ir.rlock.Unlock()
+	ir.closed = true
+	if ir.closer == nil {
+		return nil
+	}
+	err := ir.closer()
+	ir.closer = nil
+	return err
+}
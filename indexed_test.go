@@ -0,0 +1,240 @@
+package msgio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// opaqueFraming hides the frameSize fast path of the framing it wraps.
+type opaqueFraming struct {
+	Framing
+}
+
+func writeFrames(t *testing.T, f Framing, n int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := f.NewWriter(buf)
+	for i := 0; i < n; i++ {
+		if err := w.WriteMsg([]byte(fmt.Sprintf("frame %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func checkIndexed(t *testing.T, ir *IndexedReader, n int) {
+	t.Helper()
+	if ir.Len() != n {
+		t.Fatalf("expected %d frames, got %d", n, ir.Len())
+	}
+	for i := n - 1; i >= 0; i-- {
+		msg, err := ir.ReadAt(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("frame %d", i); string(msg) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg)
+		}
+		ir.ReleaseMsg(msg)
+	}
+	if _, err := ir.ReadAt(n); err != ErrIndexOutOfRange {
+		t.Fatalf("expected ErrIndexOutOfRange, got %v", err)
+	}
+}
+
+func TestIndexedReader(t *testing.T) {
+	for _, f := range []Framing{FixedFraming, VarintFraming, opaqueFraming{FixedFraming}, opaqueFraming{VarintFraming}, ResyncFraming, COBSFraming, NetstringFraming, LineFraming} {
+		t.Run(f.Name(), func(t *testing.T) {
+			data := writeFrames(t, f, 20)
+			// a truncated frame at the end is ignored
+			data = append(data, writeFrames(t, f, 1)[:3]...)
+
+			ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)), f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkIndexed(t, ir, 20)
+		})
+	}
+}
+
+func TestIndexedReaderSeek(t *testing.T) {
+	data := writeFrames(t, VarintFraming, 10)
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)), VarintFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ir.Seek(7); err != nil {
+		t.Fatal(err)
+	}
+	for i := 7; i < 10; i++ {
+		msg, err := ir.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("frame %d", i); string(msg) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg)
+		}
+	}
+	if _, err := ir.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	ir.Seek(2)
+	buf := make([]byte, 4)
+	if _, err := ir.Read(buf); err != io.ErrShortBuffer {
+		t.Fatalf("expected ErrShortBuffer, got %v", err)
+	}
+	buf = make([]byte, 100)
+	n, err := ir.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "frame 2" {
+		t.Fatalf("expected frame 2, got %q", buf[:n])
+	}
+	if err := ir.Seek(11); err != ErrIndexOutOfRange {
+		t.Fatalf("expected ErrIndexOutOfRange, got %v", err)
+	}
+}
+
+func TestIndexedReaderPersist(t *testing.T) {
+	data := writeFrames(t, FixedFraming, 10)
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)), FixedFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := new(bytes.Buffer)
+	if err := ir.WriteIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadIndexedReader(bytes.NewReader(data), int64(len(data)), FixedFraming, bytes.NewReader(idx.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexed(t, loaded, 10)
+
+	// an index for a different framing doesn't apply
+	_, err = LoadIndexedReader(bytes.NewReader(data), int64(len(data)), VarintFraming, bytes.NewReader(idx.Bytes()))
+	if err != ErrBadIndex {
+		t.Fatalf("expected ErrBadIndex, got %v", err)
+	}
+
+	// an index for a different file size is stale
+	data = append(data, writeFrames(t, FixedFraming, 1)...)
+	_, err = LoadIndexedReader(bytes.NewReader(data), int64(len(data)), FixedFraming, bytes.NewReader(idx.Bytes()))
+	if err != ErrBadIndex {
+		t.Fatalf("expected ErrBadIndex, got %v", err)
+	}
+}
+
+func TestOpenIndexedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames")
+	if err := os.WriteFile(path, writeFrames(t, VarintFraming, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ir, err := OpenIndexedFile(path, VarintFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexed(t, ir, 10)
+	if err := ir.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + IndexSuffix); err != nil {
+		t.Fatalf("expected the index to be saved: %s", err)
+	}
+
+	ir, err = OpenIndexedFile(path, VarintFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+	checkIndexed(t, ir, 10)
+}
+
+func TestOpenIndexedFileOtherFraming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames")
+	if err := os.WriteFile(path, writeFrames(t, VarintFraming, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the index saved for the wrong framing isn't reused for the right one
+	ir, err := OpenIndexedFile(path, FixedFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir.Close()
+	ir, err = OpenIndexedFile(path, VarintFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+	checkIndexed(t, ir, 10)
+}
+
+func TestIndexedReaderClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames")
+	if err := os.WriteFile(path, writeFrames(t, VarintFraming, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ir, err := OpenIndexedFile(path, VarintFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads racing with Close either succeed or fail cleanly
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i = (i + 1) % ir.Len() {
+			msg, err := ir.ReadAt(i)
+			if err == os.ErrClosed {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ir.ReleaseMsg(msg)
+		}
+	}()
+	if err := ir.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if _, err := ir.ReadAt(0); err != os.ErrClosed {
+		t.Fatalf("expected os.ErrClosed, got %v", err)
+	}
+	if _, err := ir.ReadMsg(); err != os.ErrClosed {
+		t.Fatalf("expected os.ErrClosed, got %v", err)
+	}
+	if _, err := ir.NextMsgLen(); err != os.ErrClosed {
+		t.Fatalf("expected os.ErrClosed, got %v", err)
+	}
+}
+
+func TestIndexedReaderCorruptCount(t *testing.T) {
+	// a huge count in an index with no entries, for a huge file
+	const size = 1 << 40
+	var idx [indexHeaderSize]byte
+	copy(idx[:], indexMagic)
+	idx[len(indexMagic)] = indexVersion
+	binary.BigEndian.PutUint64(idx[len(indexMagic)+1:], size)
+	binary.BigEndian.PutUint64(idx[len(indexMagic)+9:], size/8)
+	binary.BigEndian.PutUint16(idx[len(indexMagic)+17:], uint16(len(FixedFraming.Name())))
+	index := append(idx[:], FixedFraming.Name()...)
+
+	_, err := LoadIndexedReader(bytes.NewReader(nil), size, FixedFraming, bytes.NewReader(index))
+	if err != ErrBadIndex {
+		t.Fatalf("expected ErrBadIndex, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package msgio
+
+import (
+	"io"
+	"sync"
+)
+
+// ReadInterceptor intercepts every message read through a ChainReader.
+//
+// next reads a message from further down the chain. An interceptor may
+// return that message as is or transformed, call next again to drop it, or
+// return a message of its own without calling next at all. Messages that
+// are dropped or replaced should be handed to release so their buffers go
+// back to the pool.
+type ReadInterceptor func(next func() ([]byte, error), release func([]byte)) ([]byte, error)
+
+// WriteInterceptor intercepts every message written through a ChainWriter.
+//
+// next writes a message further down the chain. An interceptor may call it
+// once, with msg as is or transformed, not at all to drop msg, or several
+// times to inject messages. msg must not be retained after returning.
+type WriteInterceptor func(msg []byte, next func([]byte) error) error
+
+type chainReader struct {
+	R    Reader
+	read func() ([]byte, error)
+
+	lock sync.Mutex
+	next []byte // a message peeked by NextMsgLen or a short Read
+	peek bool
+}
+
+// ChainReader returns a ReadCloser reading from r through interceptors. The
+// first interceptor is the outermost one: it sees messages last, after
+// every other interceptor has handled them.
+func ChainReader(r Reader, interceptors ...ReadInterceptor) ReadCloser {
+	read := r.ReadMsg
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], read
+		read = func() ([]byte, error) {
+			return ic(next, r.ReleaseMsg)
+		}
+	}
+	return &chainReader{R: r, read: read}
+}
+
+// recv must be called with s.lock held.
+func (s *chainReader) recv() ([]byte, error) {
+	if s.peek {
+		msg := s.next
+		s.next, s.peek = nil, false
+		return msg, nil
+	}
+	return s.read()
+}
+
+func (s *chainReader) NextMsgLen() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msg, err := s.recv()
+	if err != nil {
+		return 0, err
+	}
+	s.next, s.peek = msg, true
+	return len(msg), nil
+}
+
+func (s *chainReader) Read(buf []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msg, err := s.recv()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(buf) {
+		s.next, s.peek = msg, true
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(buf, msg)
+	s.R.ReleaseMsg(msg)
+	return n, nil
+}
+
+func (s *chainReader) ReadMsg() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.recv()
+}
+
+func (s *chainReader) ReleaseMsg(msg []byte) {
+	s.R.ReleaseMsg(msg)
+}
+
+func (s *chainReader) Close() error {
+	if c, ok := s.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type chainWriter struct {
+	W     Writer
+	write func([]byte) error
+
+	lock sync.Mutex
+}
+
+// ChainWriter returns a WriteCloser writing to w through interceptors. The
+// first interceptor is the outermost one: it sees messages first, before
+// any other interceptor.
+func ChainWriter(w Writer, interceptors ...WriteInterceptor) WriteCloser {
+	write := w.WriteMsg
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], write
+		write = func(msg []byte) error {
+			return ic(msg, next)
+		}
+	}
+	return &chainWriter{W: w, write: write}
+}
+
+func (s *chainWriter) Write(msg []byte) (int, error) {
+	err := s.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *chainWriter) WriteMsg(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.write(msg)
+}
+
+func (s *chainWriter) Close() error {
+	if c, ok := s.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package msgio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChainWriter(t *testing.T) {
+	var order []string
+	record := func(name string) WriteInterceptor {
+		return func(msg []byte, next func([]byte) error) error {
+			order = append(order, name)
+			return next(msg)
+		}
+	}
+	upper := func(msg []byte, next func([]byte) error) error {
+		return next(bytes.ToUpper(msg))
+	}
+	dropEmpty := func(msg []byte, next func([]byte) error) error {
+		if len(msg) == 0 {
+			return nil
+		}
+		return next(msg)
+	}
+	inject := func(msg []byte, next func([]byte) error) error {
+		if err := next([]byte("header")); err != nil {
+			return err
+		}
+		return next(msg)
+	}
+
+	buf := new(bytes.Buffer)
+	w := ChainWriter(NewWriter(buf), record("a"), record("b"), dropEmpty, inject, upper)
+	for _, m := range []string{"hello", "", "world"} {
+		if err := w.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(order[:2], "") != "ab" {
+		t.Fatalf("interceptors ran out of order: %q", order)
+	}
+
+	r := NewReader(buf)
+	for _, m := range []string{"HEADER", "HELLO", "HEADER", "WORLD"} {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Fatalf("expected %q, got %q", m, msg)
+		}
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestChainReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, m := range []string{"keep", "drop", "bad", "keep"} {
+		w.WriteMsg([]byte(m))
+	}
+
+	errBad := errors.New("bad message")
+	var seen int
+	count := func(next func() ([]byte, error), release func([]byte)) ([]byte, error) {
+		msg, err := next()
+		if err == nil {
+			seen++
+		}
+		return msg, err
+	}
+	drop := func(next func() ([]byte, error), release func([]byte)) ([]byte, error) {
+		for {
+			msg, err := next()
+			if err != nil || string(msg) != "drop" {
+				return msg, err
+			}
+			release(msg)
+		}
+	}
+	validate := func(next func() ([]byte, error), release func([]byte)) ([]byte, error) {
+		msg, err := next()
+		if err == nil && string(msg) == "bad" {
+			release(msg)
+			return nil, errBad
+		}
+		return msg, err
+	}
+
+	r := ChainReader(NewReader(buf), count, validate, drop)
+	if n, err := r.NextMsgLen(); err != nil || n != 4 {
+		t.Fatalf("expected length 4, got %d (%v)", n, err)
+	}
+	msg, err := r.ReadMsg()
+	if err != nil || string(msg) != "keep" {
+		t.Fatalf("expected keep, got %q (%v)", msg, err)
+	}
+	if _, err := r.ReadMsg(); err != errBad {
+		t.Fatalf("expected errBad, got %v", err)
+	}
+	b := make([]byte, 10)
+	n, err := r.Read(b)
+	if err != nil || string(b[:n]) != "keep" {
+		t.Fatalf("expected keep, got %q (%v)", b[:n], err)
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if seen != 2 {
+		t.Fatalf("expected the outer interceptor to see 2 messages, got %d", seen)
+	}
+}
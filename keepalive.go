@@ -0,0 +1,321 @@
+package msgio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// ErrIdleTimeout is returned when a Keepalive connection receives nothing
+// from the peer within its timeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrUnknownFrame is returned when a Keepalive connection receives a frame
+// with an unknown type tag.
+var ErrUnknownFrame = errors.New("unknown frame type")
+
+// Type tags for the wrappers that multiplex control frames with
+// application frames.
+const (
+	frameData byte = iota
+	framePing
+	framePong
+	frameCredit
+)
+
+const pingSize = 8
+
+// Keepalive wraps a ReadWriteCloser with ping/pong control frames and an idle
+// timeout. Each frame on the wire is prefixed with a one byte type tag, so
+// both peers must use a Keepalive.
+//
+// Frames are read by a background goroutine, which answers pings as soon as
+// they arrive. Application frames are queued until the application reads
+// them, so that a busy application doesn't hold up the pongs. The queue is
+// not bounded; wrap the Keepalive in a FlowControl to bound it.
+type Keepalive struct {
+	rw       ReadWriteCloser
+	interval time.Duration
+	timeout  time.Duration
+	pool     *pool.BufferPool
+
+	wlock sync.Mutex
+
+	rlock sync.Mutex
+	next  []byte // a message peeked by NextMsgLen or a short Read
+
+	start    time.Time
+	lastRecv atomic.Int64 // time since start
+	pingSeq  atomic.Uint64
+	pingSent atomic.Int64 // time since start, or -1 if no ping is outstanding
+	rtt      atomic.Int64
+
+	lock   sync.Mutex
+	cond   sync.Cond // signaled when a message is queued or the connection fails
+	queue  [][]byte  // application messages not read yet
+	err    error
+	closed chan struct{}
+}
+
+// NewKeepalive wraps rw. A ping is sent once nothing has been received for
+// interval, and the connection is closed with ErrIdleTimeout once nothing has
+// been received for timeout.
+func NewKeepalive(rw ReadWriteCloser, interval, timeout time.Duration) *Keepalive {
+	if interval <= 0 || timeout <= 0 {
+		panic("non-positive keepalive interval or timeout")
+	}
+	k := &Keepalive{
+		rw:       rw,
+		interval: interval,
+		timeout:  timeout,
+		pool:     pool.GlobalPool,
+		start:    time.Now(),
+		closed:   make(chan struct{}),
+	}
+	k.cond.L = &k.lock
+	k.pingSent.Store(-1)
+	go k.readLoop()
+	go k.pingLoop()
+	return k
+}
+
+// RTT returns the most recently measured round trip time, or zero if no
+// pong has been received yet.
+func (k *Keepalive) RTT() time.Duration {
+	return time.Duration(k.rtt.Load())
+}
+
+func (k *Keepalive) now() int64 {
+	return int64(time.Since(k.start))
+}
+
+func (k *Keepalive) fail(err error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.err != nil {
+		return
+	}
+	k.err = err
+	if err != io.EOF {
+		// Messages sent before the peer closed the connection can
+		// still be read; otherwise they are dropped.
+		k.discard()
+	}
+	close(k.closed)
+	k.cond.Broadcast()
+	k.rw.Close()
+}
+
+// discard releases the queued messages. It must be called with k.lock held.
+func (k *Keepalive) discard() {
+	for _, msg := range k.queue {
+		k.rw.ReleaseMsg(msg)
+	}
+	k.queue = nil
+}
+
+// Err returns the error that terminated the connection, if any.
+func (k *Keepalive) Err() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.err
+}
+
+func (k *Keepalive) writeFrame(typ byte, msg []byte) error {
+	buf := k.pool.Get(len(msg) + 1)
+	buf[0] = typ
+	copy(buf[1:], msg)
+
+	k.wlock.Lock()
+	err := k.rw.WriteMsg(buf)
+	k.wlock.Unlock()
+	k.pool.Put(buf)
+	return err
+}
+
+func (k *Keepalive) Write(msg []byte) (int, error) {
+	err := k.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (k *Keepalive) WriteMsg(msg []byte) error {
+	if err := k.Err(); err != nil {
+		return err
+	}
+	return k.writeFrame(frameData, msg)
+}
+
+func (k *Keepalive) readLoop() {
+	for {
+		msg, err := k.rw.ReadMsg()
+		if err != nil {
+			k.fail(err)
+			return
+		}
+		k.lastRecv.Store(k.now())
+
+		if len(msg) == 0 {
+			k.fail(ErrUnknownFrame)
+			return
+		}
+		switch msg[0] {
+		case frameData:
+			// Shift the payload down in place so the pooled buffer
+			// can be handed out and released as is.
+			n := copy(msg, msg[1:])
+			k.lock.Lock()
+			if k.err != nil {
+				k.lock.Unlock()
+				k.rw.ReleaseMsg(msg)
+				return
+			}
+			k.queue = append(k.queue, msg[:n])
+			k.cond.Broadcast()
+			k.lock.Unlock()
+		case framePing:
+			// Reply in the background: the read loop must never block
+			// on the peer reading.
+			pong := append([]byte(nil), msg[1:]...)
+			k.rw.ReleaseMsg(msg)
+			go k.writeFrame(framePong, pong)
+		case framePong:
+			if len(msg) == 1+pingSize && binary.BigEndian.Uint64(msg[1:]) == k.pingSeq.Load() {
+				if sent := k.pingSent.Swap(-1); sent >= 0 {
+					k.rtt.Store(k.now() - sent)
+				}
+			}
+			k.rw.ReleaseMsg(msg)
+		default:
+			k.rw.ReleaseMsg(msg)
+			err = ErrUnknownFrame
+		}
+		if err != nil {
+			k.fail(err)
+			return
+		}
+	}
+}
+
+func (k *Keepalive) pingLoop() {
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-k.closed:
+			return
+		}
+
+		idle := time.Duration(k.now() - k.lastRecv.Load())
+		if idle >= k.timeout {
+			k.fail(ErrIdleTimeout)
+			return
+		}
+
+		next := k.timeout - idle
+		if idle >= k.interval {
+			if k.pingSent.Load() < 0 {
+				k.ping()
+			}
+		} else {
+			next = min(next, k.interval-idle)
+		}
+		timer.Reset(next)
+	}
+}
+
+// ping sends a ping in the background so that a write stuck on a dead
+// connection can't hold up the idle timeout.
+func (k *Keepalive) ping() {
+	buf := make([]byte, pingSize)
+	binary.BigEndian.PutUint64(buf, k.pingSeq.Add(1))
+	k.pingSent.Store(k.now())
+	go func() {
+		if err := k.writeFrame(framePing, buf); err != nil {
+			k.fail(err)
+		}
+	}()
+}
+
+// recv returns the next application message. The caller must hold k.rlock.
+func (k *Keepalive) recv() ([]byte, error) {
+	if k.next != nil {
+		msg := k.next
+		k.next = nil
+		return msg, nil
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for len(k.queue) == 0 && k.err == nil {
+		k.cond.Wait()
+	}
+	if len(k.queue) == 0 {
+		return nil, k.err
+	}
+	msg := k.queue[0]
+	k.queue[0] = nil
+	k.queue = k.queue[1:]
+	return msg, nil
+}
+
+func (k *Keepalive) NextMsgLen() (int, error) {
+	k.rlock.Lock()
+	defer k.rlock.Unlock()
+
+	msg, err := k.recv()
+	if err != nil {
+		return 0, err
+	}
+	k.next = msg
+	return len(msg), nil
+}
+
+func (k *Keepalive) Read(buf []byte) (int, error) {
+	k.rlock.Lock()
+	defer k.rlock.Unlock()
+
+	msg, err := k.recv()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(buf) {
+		k.next = msg
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(buf, msg)
+	k.rw.ReleaseMsg(msg)
+	return n, nil
+}
+
+func (k *Keepalive) ReadMsg() ([]byte, error) {
+	k.rlock.Lock()
+	defer k.rlock.Unlock()
+	return k.recv()
+}
+
+func (k *Keepalive) ReleaseMsg(msg []byte) {
+	k.rw.ReleaseMsg(msg)
+}
+
+// Close closes the connection and the wrapped ReadWriteCloser. Messages not
+// yet read are discarded.
+func (k *Keepalive) Close() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.discard()
+	if k.err != nil {
+		return nil
+	}
+	k.err = io.ErrClosedPipe
+	close(k.closed)
+	k.cond.Broadcast()
+	return k.rw.Close()
+}
@@ -0,0 +1,136 @@
+package msgio
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveReadWrite(t *testing.T) {
+	a, b := net.Pipe()
+	ka := NewKeepalive(NewReadWriter(a), 5*time.Millisecond, time.Second)
+	kb := NewKeepalive(NewReadWriter(b), 5*time.Millisecond, time.Second)
+	defer ka.Close()
+	defer kb.Close()
+
+	go func() {
+		for _, m := range []string{"hello", "", "world"} {
+			if err := ka.WriteMsg([]byte(m)); err != nil {
+				t.Error(err)
+			}
+			// give the ping loops a chance to run in between
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	for _, m := range []string{"hello", "", "world"} {
+		n, err := kb.NextMsgLen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(m) {
+			t.Fatalf("expected length %d, got %d", len(m), n)
+		}
+		msg, err := kb.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Fatalf("expected %q, got %q", m, msg)
+		}
+		kb.ReleaseMsg(msg)
+	}
+
+	if ka.RTT() <= 0 || kb.RTT() <= 0 {
+		t.Fatalf("expected RTTs to be measured, got %s and %s", ka.RTT(), kb.RTT())
+	}
+}
+
+func TestKeepaliveIdleTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	k := NewKeepalive(NewReadWriter(a), 5*time.Millisecond, 50*time.Millisecond)
+
+	// the peer drains the connection but never answers
+	go func() {
+		r := NewReader(b)
+		for {
+			msg, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			r.ReleaseMsg(msg)
+		}
+	}()
+
+	start := time.Now()
+	if _, err := k.ReadMsg(); err != ErrIdleTimeout {
+		t.Fatalf("expected ErrIdleTimeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("idle timeout took too long")
+	}
+	if err := k.WriteMsg([]byte("x")); err != ErrIdleTimeout {
+		t.Fatalf("expected ErrIdleTimeout, got %v", err)
+	}
+}
+
+func TestKeepaliveUnansweredWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	k := NewKeepalive(NewReadWriter(a), 5*time.Millisecond, 50*time.Millisecond)
+
+	// nobody reads b, so pings block forever
+	if _, err := k.ReadMsg(); err != ErrIdleTimeout {
+		t.Fatalf("expected ErrIdleTimeout, got %v", err)
+	}
+}
+
+func TestKeepaliveBusyReader(t *testing.T) {
+	a, b := net.Pipe()
+	ka := NewKeepalive(NewReadWriter(a), 10*time.Millisecond, 100*time.Millisecond)
+	kb := NewKeepalive(NewReadWriter(b), 10*time.Millisecond, 100*time.Millisecond)
+	defer ka.Close()
+	defer kb.Close()
+
+	if err := ka.WriteMsg([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// kb's application is busy for longer than the timeout, but kb keeps
+	// answering ka's pings.
+	time.Sleep(300 * time.Millisecond)
+	if err := ka.Err(); err != nil {
+		t.Fatalf("expected the connection to stay up, got %v", err)
+	}
+	msg, err := kb.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("expected hello, got %q", msg)
+	}
+}
+
+func TestKeepalivePeerClose(t *testing.T) {
+	a, b := net.Pipe()
+	ka := NewKeepalive(NewReadWriter(a), time.Second, time.Second)
+	kb := NewKeepalive(NewReadWriter(b), time.Second, time.Second)
+	defer kb.Close()
+
+	for _, m := range []string{"one", "two", "three"} {
+		if err := ka.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ka.Close()
+	for kb.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	// messages sent before the close are still delivered
+	expectMsgs(t, kb, "one", "two", "three")
+	if _, err := kb.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package msgio
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// ErrInvalidEscape is returned when reading a line with an unknown escape
+// sequence. The line is dropped and the next read starts at the next one.
+var ErrInvalidEscape = errors.New("invalid escape sequence")
+
+// LineFraming is the framing written by NewLineWriter.
+var LineFraming Framing = lineFraming{}
+
+type lineFraming struct{}
+
+func (lineFraming) Name() string { return "line" }
+
+func (lineFraming) NewReader(r io.Reader, maxSize int) ReadCloser {
+	return NewLineReaderSize(r, maxSize)
+}
+
+func (lineFraming) NewWriter(w io.Writer) WriteCloser {
+	return NewLineWriter(w)
+}
+
+func (lineFraming) frameSize(r io.Reader) (int, int, error) {
+	return delimitedFrameSize(r, '\n', false)
+}
+
+// lineEscape escapes msg into dst, which must hold twice its length, and
+// returns the escaped length.
+func lineEscape(dst, msg []byte) int {
+	n := 0
+	for _, b := range msg {
+		switch b {
+		case '\\':
+			n += copy(dst[n:], `\\`)
+		case '\n':
+			n += copy(dst[n:], `\n`)
+		default:
+			dst[n] = b
+			n++
+		}
+	}
+	return n
+}
+
+// lineUnescape unescapes buf in place and returns the unescaped length.
+func lineUnescape(buf []byte) (int, error) {
+	n := 0
+	for i := 0; i < len(buf); i++ {
+		b := buf[i]
+		if b == '\\' {
+			i++
+			if i == len(buf) {
+				return 0, ErrInvalidEscape
+			}
+			switch buf[i] {
+			case '\\':
+			case 'n':
+				b = '\n'
+			default:
+				return 0, ErrInvalidEscape
+			}
+		}
+		buf[n] = b
+		n++
+	}
+	return n, nil
+}
+
+func lineMaxEscapedLen(n int) int {
+	return 2 * n
+}
+
+// lineWriter is the underlying type that implements the Writer interface.
+type lineWriter struct {
+	W io.Writer
+
+	pool *pool.BufferPool
+	lock sync.Mutex
+}
+
+// NewLineWriter wraps an io.Writer with a msgio framed writer that writes
+// every message on its own line. Newlines and backslashes in messages are
+// escaped as `\n` and `\\`, so any message, text or binary, round trips.
+func NewLineWriter(w io.Writer) WriteCloser {
+	return NewLineWriterWithPool(w, pool.GlobalPool)
+}
+
+// NewLineWriterWithPool is the same as NewLineWriter but allows one to
+// specify a buffer pool.
+func NewLineWriterWithPool(w io.Writer, p *pool.BufferPool) WriteCloser {
+	if p == nil {
+		panic("nil pool")
+	}
+	return &lineWriter{W: w, pool: p}
+}
+
+func (s *lineWriter) Write(msg []byte) (int, error) {
+	err := s.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *lineWriter) WriteMsg(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf := s.pool.Get(lineMaxEscapedLen(len(msg)) + 1)
+	n := lineEscape(buf, msg)
+	buf[n] = '\n'
+	_, err := s.W.Write(buf[:n+1])
+	s.pool.Put(buf)
+
+	return err
+}
+
+func (s *lineWriter) Close() error {
+	if c, ok := s.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewLineReader wraps an io.Reader with a msgio framed reader for lines
+// written by NewLineWriter. Every line is a message, so an empty line is an
+// empty message.
+func NewLineReader(r io.Reader) ReadCloser {
+	return NewLineReaderSize(r, defaultMaxSize)
+}
+
+// NewLineReaderSize is equivalent to NewLineReader but allows one to
+// specify a max message size.
+func NewLineReaderSize(r io.Reader, maxMessageSize int) ReadCloser {
+	return NewLineReaderSizeWithPool(r, maxMessageSize, pool.GlobalPool)
+}
+
+// NewLineReaderWithPool is the same as NewLineReader but allows one to
+// specify a buffer pool.
+func NewLineReaderWithPool(r io.Reader, p *pool.BufferPool) ReadCloser {
+	return NewLineReaderSizeWithPool(r, defaultMaxSize, p)
+}
+
+// NewLineReaderSizeWithPool is the same as NewLineReader but allows one to
+// specify a buffer pool and a max message size.
+func NewLineReaderSizeWithPool(r io.Reader, maxMessageSize int, p *pool.BufferPool) ReadCloser {
+	s := newDelimitedReader(r, maxMessageSize, p)
+	s.delim = '\n'
+	s.encodedLen = lineMaxEscapedLen
+	s.decode = lineUnescape
+	return s
+}
+
+// NewLineReadWriter wraps an io.ReadWriter with a msgio.ReadWriter using
+// line framing.
+func NewLineReadWriter(rw io.ReadWriter) ReadWriteCloser {
+	return &readWriter{
+		Reader: NewLineReader(rw),
+		Writer: NewLineWriter(rw),
+	}
+}
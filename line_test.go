@@ -0,0 +1,60 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLineFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewLineWriter(buf)
+	for _, m := range []string{"plain text", "", "two\nlines", `back\slash`} {
+		if err := w.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := "plain text\n\ntwo\\nlines\nback\\\\slash\n"; buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+
+	r := NewLineReader(buf)
+	expectMsgs(t, r, "plain text", "", "two\nlines", `back\slash`)
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestLineInvalidEscape(t *testing.T) {
+	r := NewLineReader(strings.NewReader("bad \\t escape\ntrailing\\\nok\n"))
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadMsg(); err != ErrInvalidEscape {
+			t.Fatalf("expected ErrInvalidEscape, got %v", err)
+		}
+	}
+	expectMsgs(t, r, "ok")
+}
+
+func TestLineMaxSize(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	r := NewLineReaderSize(strings.NewReader(long+"\nshort\n12345\nok\n"), 5)
+	if _, err := r.ReadMsg(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	expectMsgs(t, r, "short", "12345", "ok")
+}
+
+func TestLineReadWriter(t *testing.T) {
+	a, b := net.Pipe()
+	ra, rb := NewLineReadWriter(a), NewLineReadWriter(b)
+	defer ra.Close()
+	defer rb.Close()
+
+	go ra.WriteMsg([]byte("multi\nline"))
+	if n, err := rb.NextMsgLen(); err != nil || n != 10 {
+		t.Fatalf("expected length 10, got %d, %v", n, err)
+	}
+	expectMsgs(t, rb, "multi\nline")
+}
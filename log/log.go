@@ -0,0 +1,360 @@
+// Package log implements an append-only message log stored in rolling
+// segment files.
+//
+// Messages are numbered from zero in the order they are appended. Each
+// segment file holds a run of consecutive messages as msgio frames, each
+// carrying a CRC-32C of the message, next to an index file of record
+// positions that makes reading message N a constant time operation. When
+// the log is opened, the newest segment is scanned and any torn or corrupt
+// records at its end, left behind by a crash, are truncated away.
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+)
+
+var (
+	// ErrCorrupt is returned when a stored message fails its checksum.
+	ErrCorrupt = errors.New("log: corrupt record")
+
+	// ErrOutOfRange is returned when reading a message that hasn't been
+	// appended.
+	ErrOutOfRange = errors.New("log: offset out of range")
+
+	// ErrClosed is returned when using a closed log.
+	ErrClosed = errors.New("log: closed")
+)
+
+// SyncPolicy decides when appended messages are fsynced to disk.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system. Call Sync to
+	// force it.
+	SyncNever SyncPolicy = iota
+	// SyncOnRotate syncs a segment when it is sealed.
+	SyncOnRotate
+	// SyncAlways syncs after every append.
+	SyncAlways
+)
+
+const (
+	defaultSegmentSize = 64 * 1024 * 1024 // 64mb
+	defaultMaxSize     = 8 * 1024 * 1024  // 8mb
+)
+
+// Options configures a Log. A nil Options uses the defaults.
+type Options struct {
+	// SegmentSize is the size in bytes after which a new segment is
+	// started. Defaults to 64MiB.
+	SegmentSize int64
+
+	// MaxMessageSize is the size of the largest message accepted.
+	// Defaults to 8MiB.
+	MaxMessageSize int
+
+	// Sync is the fsync policy. Defaults to SyncNever.
+	Sync SyncPolicy
+}
+
+// Log is an append-only message log. It implements msgio.WriteCloser, so it
+// can be used wherever messages are written. All methods are safe for
+// concurrent use.
+//
+// Every segment keeps two files open for the lifetime of the Log.
+type Log struct {
+	dir         string
+	segmentSize int64
+	maxSize     int
+	sync        SyncPolicy
+
+	lock     sync.RWMutex
+	segments []*segment // ordered by base; the last one is active
+	closed   bool
+}
+
+// Open opens the log in dir, creating the directory if needed.
+func Open(dir string, opts *Options) (*Log, error) {
+	l := &Log{
+		dir:         dir,
+		segmentSize: defaultSegmentSize,
+		maxSize:     defaultMaxSize,
+	}
+	if opts != nil {
+		if opts.SegmentSize > 0 {
+			l.segmentSize = opts.SegmentSize
+		}
+		if opts.MaxMessageSize > 0 {
+			l.maxSize = opts.MaxMessageSize
+		}
+		l.sync = opts.Sync
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	bases, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, base := range bases {
+		s, err := openSegment(dir, base, l.maxSize, i == len(bases)-1)
+		if err != nil {
+			l.closeSegments()
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+	if len(l.segments) == 0 {
+		s, err := createSegment(dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+	return l, nil
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var bases []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != segmentExt {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+func (l *Log) active() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// Len returns the number of messages in the log, which is also the offset
+// the next message will be appended at.
+func (l *Log) Len() uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	s := l.active()
+	return s.base + s.count
+}
+
+// Append appends msg and returns its offset.
+func (l *Log) Append(msg []byte) (uint64, error) {
+	if len(msg) > l.maxSize {
+		return 0, msgio.ErrMsgTooLarge
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	s := l.active()
+	if s.count > 0 && s.size+headerSize+int64(len(msg)) > l.segmentSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+		s = l.active()
+	}
+
+	if err := s.append(msg); err != nil {
+		return 0, err
+	}
+	if l.sync == SyncAlways {
+		if err := s.sync(); err != nil {
+			return 0, err
+		}
+	}
+	return s.base + s.count - 1, nil
+}
+
+// rotate seals the active segment and starts a new one. It must be called
+// with l.lock held.
+func (l *Log) rotate() error {
+	s := l.active()
+	if l.sync == SyncOnRotate {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	next, err := createSegment(l.dir, s.base+s.count)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, next)
+	return nil
+}
+
+// Write appends msg, see Append.
+func (l *Log) Write(msg []byte) (int, error) {
+	if _, err := l.Append(msg); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// WriteMsg appends msg, see Append.
+func (l *Log) WriteMsg(msg []byte) error {
+	_, err := l.Append(msg)
+	return err
+}
+
+// Read returns the message at offset n in a pooled buffer, which may be
+// handed back with ReleaseMsg.
+func (l *Log) Read(n uint64) ([]byte, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].base > n
+	}) - 1
+	if i < 0 {
+		return nil, ErrOutOfRange
+	}
+	s := l.segments[i]
+	if n-s.base >= s.count {
+		return nil, ErrOutOfRange
+	}
+	return s.read(n - s.base)
+}
+
+// ReleaseMsg signals a buffer returned by Read can be reused.
+func (l *Log) ReleaseMsg(msg []byte) {
+	pool.Put(msg)
+}
+
+// Sync flushes the active segment to disk.
+func (l *Log) Sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.active().sync()
+}
+
+// Close syncs the active segment unless the policy is SyncNever, and closes
+// every segment.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	var err error
+	if l.sync != SyncNever {
+		err = l.active().sync()
+	}
+	if cerr := l.closeSegments(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (l *Log) closeSegments() error {
+	var err error
+	for _, s := range l.segments {
+		if cerr := s.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewReader returns a msgio.ReadCloser reading the log sequentially from
+// offset from. It returns io.EOF once it reaches the end of the log, and
+// picks up messages appended later on the next read. Closing it does not
+// close the log.
+func (l *Log) NewReader(from uint64) msgio.ReadCloser {
+	return &reader{log: l, next: from}
+}
+
+type reader struct {
+	log *Log
+
+	lock sync.Mutex
+	next uint64
+}
+
+func (r *reader) NextMsgLen() (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.read()
+	if err != nil {
+		return 0, err
+	}
+	defer r.log.ReleaseMsg(msg)
+	return len(msg), nil
+}
+
+func (r *reader) read() ([]byte, error) {
+	msg, err := r.log.Read(r.next)
+	if err == ErrOutOfRange && r.next >= r.log.Len() {
+		return nil, io.EOF
+	}
+	return msg, err
+}
+
+func (r *reader) Read(buf []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.read()
+	if err != nil {
+		return 0, err
+	}
+	defer r.log.ReleaseMsg(msg)
+	if len(msg) > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	r.next++
+	return copy(buf, msg), nil
+}
+
+func (r *reader) ReadMsg() ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	r.next++
+	return msg, nil
+}
+
+func (r *reader) ReleaseMsg(msg []byte) {
+	r.log.ReleaseMsg(msg)
+}
+
+func (r *reader) Close() error {
+	return nil
+}
@@ -0,0 +1,220 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+func appendN(t *testing.T, l *Log, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		off, err := l.Append([]byte(fmt.Sprintf("message %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if off != uint64(i) {
+			t.Fatalf("expected offset %d, got %d", i, off)
+		}
+	}
+}
+
+func checkN(t *testing.T, l *Log, n int) {
+	t.Helper()
+	if l.Len() != uint64(n) {
+		t.Fatalf("expected %d messages, got %d", n, l.Len())
+	}
+	for i := n - 1; i >= 0; i-- {
+		msg, err := l.Read(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("message %d", i); string(msg) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg)
+		}
+		l.ReleaseMsg(msg)
+	}
+	if _, err := l.Read(uint64(n)); err != ErrOutOfRange {
+		t.Fatalf("expected ErrOutOfRange, got %v", err)
+	}
+}
+
+func segments(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestAppendRead(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, &Options{SegmentSize: 100, Sync: SyncOnRotate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 0, 50)
+	checkN(t, l, 50)
+	if len(segments(t, dir)) < 2 {
+		t.Fatal("expected the log to rotate")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir, &Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkN(t, l, 50)
+	appendN(t, l, 50, 60)
+	checkN(t, l, 60)
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, &Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 0, 20)
+	l.Close()
+
+	// simulate a crash halfway through writing a record
+	segs := segments(t, dir)
+	f, err := os.OpenFile(segs[len(segs)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 50, 1, 2, 3})
+	f.Close()
+
+	l, err = Open(dir, &Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkN(t, l, 20)
+	appendN(t, l, 20, 25)
+	checkN(t, l, 25)
+}
+
+func TestRecoverMissingIndex(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 0, 10)
+	l.Close()
+
+	if err := os.Remove(segmentPath(dir, 0, indexExt)); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkN(t, l, 10)
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendN(t, l, 0, 2)
+
+	f, err := os.OpenFile(segmentPath(dir, 0, segmentExt), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("X"), headerSize)
+	f.Close()
+
+	if _, err := l.Read(0); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if _, err := l.Read(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordsAreFrames(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 0, 3)
+	l.Close()
+
+	f, err := os.Open(segmentPath(dir, 0, segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := msgio.NewReader(f)
+	for i := 0; i < 3; i++ {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("message %d", i); string(msg[checksumSize:]) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg[checksumSize:])
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	l, err := Open(t.TempDir(), &Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendN(t, l, 0, 10)
+
+	r := l.NewReader(5)
+	for i := 5; i < 10; i++ {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("message %d", i); string(msg) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg)
+		}
+		r.ReleaseMsg(msg)
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	appendN(t, l, 10, 11)
+	buf := make([]byte, 100)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "message 10" {
+		t.Fatalf("expected message 10, got %q", buf[:n])
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	l, err := Open(t.TempDir(), &Options{MaxMessageSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := l.Append([]byte("too large")); err != msgio.ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+}
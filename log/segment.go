@@ -0,0 +1,249 @@
+package log
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+)
+
+const (
+	lengthSize   = 4
+	checksumSize = 4
+	headerSize   = lengthSize + checksumSize
+	indexEntry   = 8
+
+	segmentExt = ".seg"
+	indexExt   = ".idx"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errTorn is returned by scan for a record that was only partially written.
+var errTorn = errors.New("torn record")
+
+// segment is a single log file holding messages base to base+count-1, and
+// its index of record positions.
+//
+// A record is a msgio frame whose payload is the CRC-32C of the message
+// followed by the message itself. The index holds the big endian uint64
+// position of each record.
+type segment struct {
+	base  uint64
+	count uint64
+	size  int64
+
+	data  *os.File
+	index *os.File
+}
+
+func segmentPath(dir string, base uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, ext))
+}
+
+func createSegment(dir string, base uint64) (*segment, error) {
+	data, err := os.OpenFile(segmentPath(dir, base, segmentExt), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(segmentPath(dir, base, indexExt), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return &segment{base: base, data: data, index: index}, nil
+}
+
+// openSegment opens an existing segment. If recover is set, or the index
+// doesn't match the data, the data is rescanned: torn or corrupt trailing
+// records are truncated away and the index is rebuilt.
+func openSegment(dir string, base uint64, maxSize int, recover bool) (*segment, error) {
+	data, err := os.OpenFile(segmentPath(dir, base, segmentExt), os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(segmentPath(dir, base, indexExt), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	s := &segment{base: base, data: data, index: index}
+
+	if err := s.load(maxSize, recover); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *segment) load(maxSize int, recover bool) error {
+	dst, err := s.data.Stat()
+	if err != nil {
+		return err
+	}
+	ist, err := s.index.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = dst.Size()
+	s.count = uint64(ist.Size() / indexEntry)
+
+	if !recover && ist.Size()%indexEntry == 0 && s.indexConsistent() {
+		return nil
+	}
+	return s.rebuild(maxSize)
+}
+
+// indexConsistent checks that the last indexed record ends exactly at the
+// end of the data.
+func (s *segment) indexConsistent() bool {
+	if s.count == 0 {
+		return s.size == 0
+	}
+	pos, err := s.position(s.count - 1)
+	if err != nil {
+		return false
+	}
+	var hdr [lengthSize]byte
+	if _, err := s.data.ReadAt(hdr[:], pos); err != nil {
+		return false
+	}
+	return pos+lengthSize+int64(msgio.NBO.Uint32(hdr[:])) == s.size
+}
+
+// rebuild scans the data, truncates it after the last valid record and
+// rewrites the index.
+func (s *segment) rebuild(maxSize int) error {
+	var (
+		pos     int64
+		entries []byte
+		entry   [indexEntry]byte
+	)
+	for {
+		n, err := s.scan(pos, maxSize)
+		if err != nil {
+			break
+		}
+		binary.BigEndian.PutUint64(entry[:], uint64(pos))
+		entries = append(entries, entry[:]...)
+		pos += n
+	}
+
+	if pos != s.size {
+		if err := s.data.Truncate(pos); err != nil {
+			return err
+		}
+		s.size = pos
+	}
+	if err := s.index.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.index.WriteAt(entries, 0); err != nil {
+		return err
+	}
+	s.count = uint64(len(entries) / indexEntry)
+	return nil
+}
+
+// scan validates the record at pos and returns its size on disk.
+func (s *segment) scan(pos int64, maxSize int) (int64, error) {
+	var hdr [headerSize]byte
+	if _, err := s.data.ReadAt(hdr[:], pos); err != nil {
+		return 0, errTorn
+	}
+	l := int64(msgio.NBO.Uint32(hdr[:lengthSize]))
+	if l < checksumSize || l-checksumSize > int64(maxSize) || pos+lengthSize+l > s.size {
+		return 0, errTorn
+	}
+
+	buf := pool.Get(int(l - checksumSize))
+	defer pool.Put(buf)
+	if _, err := s.data.ReadAt(buf, pos+headerSize); err != nil {
+		return 0, errTorn
+	}
+	if crc32.Checksum(buf, castagnoli) != binary.BigEndian.Uint32(hdr[lengthSize:]) {
+		return 0, ErrCorrupt
+	}
+	return lengthSize + l, nil
+}
+
+func (s *segment) position(i uint64) (int64, error) {
+	var entry [indexEntry]byte
+	if _, err := s.index.ReadAt(entry[:], int64(i*indexEntry)); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(entry[:])), nil
+}
+
+// append writes msg as the next record. On failure the segment is left
+// unchanged as far as readers are concerned.
+func (s *segment) append(msg []byte) error {
+	buf := pool.Get(headerSize + len(msg))
+	defer pool.Put(buf)
+	msgio.NBO.PutUint32(buf, uint32(checksumSize+len(msg)))
+	binary.BigEndian.PutUint32(buf[lengthSize:], crc32.Checksum(msg, castagnoli))
+	copy(buf[headerSize:], msg)
+
+	if _, err := s.data.WriteAt(buf, s.size); err != nil {
+		return err
+	}
+	var entry [indexEntry]byte
+	binary.BigEndian.PutUint64(entry[:], uint64(s.size))
+	if _, err := s.index.WriteAt(entry[:], int64(s.count*indexEntry)); err != nil {
+		return err
+	}
+	s.size += int64(len(buf))
+	s.count++
+	return nil
+}
+
+// read returns message i of the segment in a pooled buffer.
+func (s *segment) read(i uint64) ([]byte, error) {
+	pos, err := s.position(i)
+	if err != nil {
+		return nil, err
+	}
+	var hdr [headerSize]byte
+	if _, err := s.data.ReadAt(hdr[:], pos); err != nil {
+		return nil, err
+	}
+	l := int(msgio.NBO.Uint32(hdr[:lengthSize]))
+	if l < checksumSize {
+		return nil, ErrCorrupt
+	}
+
+	msg := pool.Get(l - checksumSize)
+	if _, err := s.data.ReadAt(msg, pos+headerSize); err != nil {
+		pool.Put(msg)
+		if err == io.EOF {
+			err = ErrCorrupt
+		}
+		return nil, err
+	}
+	if crc32.Checksum(msg, castagnoli) != binary.BigEndian.Uint32(hdr[lengthSize:]) {
+		pool.Put(msg)
+		return nil, ErrCorrupt
+	}
+	return msg, nil
+}
+
+func (s *segment) sync() error {
+	if err := s.data.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+func (s *segment) close() error {
+	err := s.data.Close()
+	if ierr := s.index.Close(); err == nil {
+		err = ierr
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps f into memory and returns a reader over the mapping, and a
+// function that unmaps it and closes f.
+func mmapFile(f *os.File, size int64) (io.ReaderAt, func() error, error) {
+	if size == 0 {
+		return f, f.Close, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	closer := func() error {
+		err := syscall.Munmap(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return bytes.NewReader(data), closer, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package msgio
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads f directly where memory mapping isn't supported.
+func mmapFile(f *os.File, size int64) (io.ReaderAt, func() error, error) {
+	return f, f.Close, nil
+}
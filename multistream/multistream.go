@@ -0,0 +1,168 @@
+// Package multistream implements the message format of libp2p's
+// multistream-select and a minimal negotiation on top of it.
+//
+// Every message is a protocol id, or one of the special messages "na" and
+// "ls", terminated by a newline and framed with a uvarint length prefix.
+package multistream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+var (
+	// ErrMissingNewline is returned when reading a message that doesn't end
+	// with a newline.
+	ErrMissingNewline = errors.New("multistream: message missing trailing newline")
+
+	// ErrTooLong is returned when reading or writing a message longer than
+	// MaxMessageSize.
+	ErrTooLong = errors.New("multistream: message too long")
+
+	// ErrInvalidProtocol is returned when writing a message that is empty or
+	// contains a newline.
+	ErrInvalidProtocol = errors.New("multistream: invalid protocol id")
+
+	// ErrIncorrectVersion is returned when the peer doesn't speak
+	// multistream-select 1.0.0.
+	ErrIncorrectVersion = errors.New("multistream: incorrect version")
+
+	// ErrNotSupported is returned when the peers share no protocol.
+	ErrNotSupported = errors.New("multistream: protocols not supported")
+)
+
+const (
+	// ProtocolID is the protocol id of multistream-select itself, which
+	// both peers send first.
+	ProtocolID = "/multistream/1.0.0"
+
+	// NA is the reply to a protocol that isn't supported.
+	NA = "na"
+
+	// MaxMessageSize is the size of the largest message, including the
+	// newline.
+	MaxMessageSize = 1024
+)
+
+// Codec reads and writes multistream-select messages.
+type Codec struct {
+	r msgio.ReadCloser
+	w msgio.WriteCloser
+}
+
+// NewCodec returns a Codec on rw. It reads no more from rw than the
+// messages it returns, so rw can be handed over to the negotiated protocol
+// afterwards.
+func NewCodec(rw io.ReadWriter) *Codec {
+	return &Codec{
+		r: msgio.NewVarintReaderSize(rw, MaxMessageSize),
+		w: msgio.NewVarintWriter(rw),
+	}
+}
+
+// WriteMsg writes msg followed by a newline.
+func (c *Codec) WriteMsg(msg string) error {
+	if msg == "" || strings.Contains(msg, "\n") {
+		return ErrInvalidProtocol
+	}
+	if len(msg)+1 > MaxMessageSize {
+		return ErrTooLong
+	}
+	return c.w.WriteMsg([]byte(msg + "\n"))
+}
+
+// ReadMsg reads a message and returns it without its newline.
+func (c *Codec) ReadMsg() (string, error) {
+	buf, err := c.r.ReadMsg()
+	if err == msgio.ErrMsgTooLarge {
+		return "", ErrTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	defer c.r.ReleaseMsg(buf)
+	if len(buf) == 0 || buf[len(buf)-1] != '\n' {
+		return "", ErrMissingNewline
+	}
+	return string(buf[:len(buf)-1]), nil
+}
+
+// handshake exchanges the multistream protocol id. The listener only sends
+// its id once it has read the dialer's, so neither side is left writing
+// while the other isn't reading.
+func (c *Codec) handshake(dialer bool) error {
+	if dialer {
+		if err := c.WriteMsg(ProtocolID); err != nil {
+			return err
+		}
+	}
+	msg, err := c.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg != ProtocolID {
+		return ErrIncorrectVersion
+	}
+	if !dialer {
+		return c.WriteMsg(ProtocolID)
+	}
+	return nil
+}
+
+// SelectOneOf proposes protos to the listener on rw in order, and returns
+// the first one it accepts.
+func SelectOneOf(rw io.ReadWriter, protos ...string) (string, error) {
+	c := NewCodec(rw)
+	if err := c.handshake(true); err != nil {
+		return "", err
+	}
+	for _, proto := range protos {
+		if err := c.WriteMsg(proto); err != nil {
+			return "", err
+		}
+		reply, err := c.ReadMsg()
+		if err != nil {
+			return "", err
+		}
+		switch reply {
+		case proto:
+			return proto, nil
+		case NA:
+		default:
+			return "", fmt.Errorf("multistream: unexpected reply %q", reply)
+		}
+	}
+	return "", ErrNotSupported
+}
+
+// Negotiate answers the proposals of the dialer on rw, accepting the first
+// one that is among protos, and returns it. Anything else, including "ls",
+// is answered with NA. It gives up with ErrNotSupported once the dialer
+// stops proposing.
+func Negotiate(rw io.ReadWriter, protos ...string) (string, error) {
+	c := NewCodec(rw)
+	if err := c.handshake(false); err != nil {
+		return "", err
+	}
+	for {
+		proposal, err := c.ReadMsg()
+		if err == io.EOF {
+			return "", ErrNotSupported
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, proto := range protos {
+			if proposal == proto {
+				return proto, c.WriteMsg(proto)
+			}
+		}
+		if err := c.WriteMsg(NA); err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package multistream
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+func TestCodecFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	c := NewCodec(buf)
+	if err := c.WriteMsg(ProtocolID); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\x13/multistream/1.0.0\n"; buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+	msg, err := c.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != ProtocolID {
+		t.Fatalf("expected %s, got %s", ProtocolID, msg)
+	}
+}
+
+func TestCodecValidation(t *testing.T) {
+	c := NewCodec(new(bytes.Buffer))
+	if err := c.WriteMsg("two\nlines"); err != ErrInvalidProtocol {
+		t.Fatalf("expected ErrInvalidProtocol, got %v", err)
+	}
+	if err := c.WriteMsg(strings.Repeat("x", MaxMessageSize)); err != ErrTooLong {
+		t.Fatalf("expected ErrTooLong, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	w := msgio.NewVarintWriter(buf)
+	w.WriteMsg([]byte("/no/newline"))
+	w.WriteMsg([]byte(strings.Repeat("x", MaxMessageSize) + "\n"))
+	c = NewCodec(buf)
+	if _, err := c.ReadMsg(); err != ErrMissingNewline {
+		t.Fatalf("expected ErrMissingNewline, got %v", err)
+	}
+	if _, err := c.ReadMsg(); err != ErrTooLong {
+		t.Fatalf("expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		proto, err := Negotiate(b, "/echo/1.0.0", "/chat/2.0.0")
+		if err == nil && proto != "/chat/2.0.0" {
+			t.Errorf("expected /chat/2.0.0, got %s", proto)
+		}
+		done <- err
+	}()
+
+	proto, err := SelectOneOf(a, "/chat/3.0.0", "/chat/2.0.0", "/echo/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "/chat/2.0.0" {
+		t.Fatalf("expected /chat/2.0.0, got %s", proto)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream is handed over untouched
+	go a.Write([]byte("after"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "after" {
+		t.Fatalf("expected after, got %q", buf)
+	}
+}
+
+func TestNotSupported(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Negotiate(b, "/echo/1.0.0")
+		done <- err
+	}()
+	if _, err := SelectOneOf(a, "/chat/1.0.0"); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+	a.Close()
+	if err := <-done; err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestIncorrectVersion(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go NewCodec(a).WriteMsg("/multistream/2.0.0")
+	if _, err := Negotiate(b); err != ErrIncorrectVersion {
+		t.Fatalf("expected ErrIncorrectVersion, got %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package mux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-varint"
+)
+
+func newPair(t *testing.T, cfg *Config) (*Session, *Session) {
+	a, b := net.Pipe()
+	client := Client(msgio.NewReadWriter(a), cfg)
+	server := Server(msgio.NewReadWriter(b), cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestOpenAccept(t *testing.T) {
+	client, server := newPair(t, nil)
+
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.ID() != ss.ID() {
+		t.Fatalf("stream IDs differ: %d != %d", cs.ID(), ss.ID())
+	}
+
+	if err := cs.WriteMsg([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ss.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("expected hello, got %q", msg)
+	}
+	ss.ReleaseMsg(msg)
+
+	if err := ss.WriteMsg([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := cs.Read(buf); err != io.ErrShortBuffer {
+		t.Fatalf("expected short buffer, got %v", err)
+	}
+	if n, _ := cs.NextMsgLen(); n != 5 {
+		t.Fatalf("expected next length 5, got %d", n)
+	}
+	buf = make([]byte, 10)
+	n, err := cs.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Fatalf("expected world, got %q", buf[:n])
+	}
+}
+
+func TestManyStreams(t *testing.T) {
+	client, server := newPair(t, &Config{Window: 4})
+
+	const streams, msgs = 10, 100
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < streams; i++ {
+			st, err := server.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// echo every message back, then close
+				for {
+					msg, err := st.ReadMsg()
+					if err == io.EOF {
+						st.Close()
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if err := st.WriteMsg(msg); err != nil {
+						t.Error(err)
+					}
+					st.ReleaseMsg(msg)
+				}
+			}()
+		}
+	}()
+
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			go func() {
+				for j := 0; j < msgs; j++ {
+					if err := st.WriteMsg([]byte(fmt.Sprintf("%d-%d", i, j))); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				st.Close()
+			}()
+			for j := 0; ; j++ {
+				msg, err := st.ReadMsg()
+				if err == io.EOF {
+					if j != msgs {
+						t.Errorf("stream %d: got %d messages, expected %d", i, j, msgs)
+					}
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if expected := fmt.Sprintf("%d-%d", i, j); string(msg) != expected {
+					t.Errorf("expected %q, got %q", expected, msg)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestFlowControl(t *testing.T) {
+	client, server := newPair(t, &Config{Window: 2})
+
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := cs.WriteMsg([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	written := make(chan error)
+	go func() { written <- cs.WriteMsg([]byte("y")) }()
+	select {
+	case <-written:
+		t.Fatal("write should block while the window is exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := ss.ReadMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWindowOverflow(t *testing.T) {
+	a, b := net.Pipe()
+	client := Client(msgio.NewReadWriter(a), nil)
+	defer client.Close()
+	peer := msgio.NewReadWriter(b)
+
+	// The peer reads the open and window frames, then grants an
+	// impossible window.
+	go func() {
+		for i := 0; i < 2; i++ {
+			msg, err := peer.ReadMsg()
+			if err != nil {
+				return
+			}
+			peer.ReleaseMsg(msg)
+		}
+		frame := append(varint.ToUvarint(1), flagWindow)
+		frame = append(frame, varint.ToUvarint(1<<63)...)
+		peer.WriteMsg(frame)
+	}()
+
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.WriteMsg([]byte("x")); err != ErrProtocol {
+		t.Fatalf("expected ErrProtocol, got %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := newPair(t, nil)
+
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.ReadMsg(); err != ErrStreamReset {
+		t.Fatalf("expected reset, got %v", err)
+	}
+	if err := cs.WriteMsg([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("expected reset, got %v", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := newPair(t, nil)
+
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	if _, err := cs.ReadMsg(); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+	if _, err := client.Open(); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+	if _, err := server.Accept(); err == nil {
+		t.Fatal("expected accept to fail once the peer is gone")
+	}
+}
+
+func TestSessionCloseDrain(t *testing.T) {
+	client, server := newPair(t, nil)
+
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"a", "b"} {
+		if err := cs.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cs.Close()
+	client.Close()
+
+	// messages sent before the stream was closed are still delivered
+	for _, m := range []string{"a", "b"} {
+		msg, err := ss.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Fatalf("expected %q, got %q", m, msg)
+		}
+	}
+	if _, err := ss.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+// Package mux multiplexes independent message streams over a single
+// msgio.ReadWriteCloser.
+//
+// Every underlying frame starts with a uvarint stream ID and a flag byte,
+// followed by the payload. Streams opened by the client use odd IDs and
+// streams opened by the server use even IDs, so both sides can open streams
+// without coordination.
+package mux
+
+import (
+	"errors"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-varint"
+)
+
+var (
+	// ErrSessionClosed is returned when using a session, or a stream of a
+	// session, that has been closed.
+	ErrSessionClosed = errors.New("mux: session closed")
+
+	// ErrStreamClosed is returned when writing to a stream after Close.
+	ErrStreamClosed = errors.New("mux: stream closed for writing")
+
+	// ErrStreamReset is returned when using a stream that was reset by
+	// either side.
+	ErrStreamReset = errors.New("mux: stream reset")
+
+	// ErrProtocol is returned when the peer violates the framing protocol.
+	ErrProtocol = errors.New("mux: protocol error")
+)
+
+const (
+	flagOpen byte = iota
+	flagData
+	flagClose
+	flagReset
+	flagWindow
+)
+
+const (
+	defaultWindow        = 256
+	defaultAcceptBacklog = 64
+	maxHeaderSize        = varint.MaxLenUvarint63 + 1
+)
+
+// Config configures a Session. A nil Config uses the defaults.
+type Config struct {
+	// Window is the number of messages a peer may send on a stream
+	// before the receiving application consumes them. Defaults to 256.
+	Window int
+
+	// AcceptBacklog is the number of inbound streams that may wait for
+	// Accept before new ones are reset. Defaults to 64.
+	AcceptBacklog int
+}
+
+// Session multiplexes streams over one msgio.ReadWriteCloser.
+type Session struct {
+	rw     msgio.ReadWriteCloser
+	window int
+	parity uint64 // parity of the stream IDs we open
+	pool   *pool.BufferPool
+
+	wlock sync.Mutex
+
+	lock    sync.Mutex
+	streams map[uint64]*Stream
+	nextID  uint64
+	err     error
+
+	accept   chan *Stream
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// Client starts the client side of a session over rw. The session owns rw
+// from now on and closes it on Close.
+func Client(rw msgio.ReadWriteCloser, cfg *Config) *Session {
+	return newSession(rw, cfg, 1)
+}
+
+// Server starts the server side of a session over rw. The session owns rw
+// from now on and closes it on Close.
+func Server(rw msgio.ReadWriteCloser, cfg *Config) *Session {
+	return newSession(rw, cfg, 2)
+}
+
+func newSession(rw msgio.ReadWriteCloser, cfg *Config, firstID uint64) *Session {
+	window, backlog := defaultWindow, defaultAcceptBacklog
+	if cfg != nil {
+		if cfg.Window > 0 {
+			window = cfg.Window
+		}
+		if cfg.AcceptBacklog > 0 {
+			backlog = cfg.AcceptBacklog
+		}
+	}
+	s := &Session{
+		rw:       rw,
+		window:   window,
+		parity:   firstID % 2,
+		pool:     pool.GlobalPool,
+		streams:  make(map[uint64]*Stream),
+		nextID:   firstID,
+		accept:   make(chan *Stream, backlog),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open opens a new outbound stream.
+func (s *Session) Open() (*Stream, error) {
+	s.lock.Lock()
+	if s.err != nil {
+		err := s.err
+		s.lock.Unlock()
+		return nil, err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.writeFrame(id, flagOpen, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	if err := s.writeWindow(id, s.window); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.shutdown:
+		return nil, s.Err()
+	}
+}
+
+// Err returns the error that terminated the session, if any.
+func (s *Session) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Close closes the session and the underlying ReadWriteCloser, and aborts
+// every open stream. Messages on a stream the peer had closed can still be
+// read.
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	err := s.rw.Close()
+	<-s.done
+	return err
+}
+
+func (s *Session) fail(err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint64]*Stream)
+	s.lock.Unlock()
+
+	close(s.shutdown)
+	for _, st := range streams {
+		st.sessionFailed(err)
+	}
+}
+
+func (s *Session) removeStream(id uint64) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+func (s *Session) writeFrame(id uint64, flag byte, payload []byte) error {
+	buf := s.pool.Get(maxHeaderSize + len(payload))
+	n := varint.PutUvarint(buf, id)
+	buf[n] = flag
+	n++
+	n += copy(buf[n:], payload)
+
+	s.wlock.Lock()
+	err := s.rw.WriteMsg(buf[:n])
+	s.wlock.Unlock()
+	s.pool.Put(buf)
+
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// reset resets st from the read loop.
+func (s *Session) reset(st *Stream) {
+	st.abort(ErrStreamReset)
+	s.removeStream(st.id)
+	go s.writeFrame(st.id, flagReset, nil)
+}
+
+func (s *Session) writeWindow(id uint64, delta int) error {
+	var buf [varint.MaxLenUvarint63]byte
+	n := varint.PutUvarint(buf[:], uint64(delta))
+	return s.writeFrame(id, flagWindow, buf[:n])
+}
+
+func (s *Session) readLoop() {
+	defer close(s.done)
+	for {
+		msg, err := s.rw.ReadMsg()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		err = s.handleFrame(msg)
+		s.rw.ReleaseMsg(msg)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(msg []byte) error {
+	id, n, err := varint.FromUvarint(msg)
+	if err != nil || n >= len(msg) {
+		return ErrProtocol
+	}
+	flag, payload := msg[n], msg[n+1:]
+
+	s.lock.Lock()
+	st := s.streams[id]
+	s.lock.Unlock()
+
+	switch flag {
+	case flagOpen:
+		if st != nil || id == 0 || id%2 == s.parity {
+			return ErrProtocol
+		}
+		st = newStream(s, id)
+		s.lock.Lock()
+		if s.err != nil {
+			s.lock.Unlock()
+			return nil
+		}
+		s.streams[id] = st
+		s.lock.Unlock()
+
+		select {
+		case s.accept <- st:
+			// Writes from the read loop happen in the background so two
+			// sessions can't deadlock writing to each other.
+			go s.writeWindow(id, s.window)
+		default:
+			s.reset(st)
+		}
+	case flagData:
+		if st == nil {
+			return nil
+		}
+		buf := s.pool.Get(len(payload))
+		copy(buf, payload)
+		if !st.push(buf) {
+			s.pool.Put(buf)
+			s.reset(st)
+		}
+	case flagClose:
+		if st != nil {
+			st.remoteClose()
+		}
+	case flagReset:
+		if st != nil {
+			st.abort(ErrStreamReset)
+			s.removeStream(id)
+		}
+	case flagWindow:
+		delta, _, err := varint.FromUvarint(payload)
+		if err != nil {
+			return ErrProtocol
+		}
+		if st != nil && !st.grant(delta) {
+			return ErrProtocol
+		}
+	default:
+		return ErrProtocol
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package mux
+
+import (
+	"io"
+	"math"
+	"sync"
+)
+
+// Stream is a single logical message stream within a Session. It implements
+// msgio.ReadWriteCloser.
+//
+// Close only closes the write side: the peer reads io.EOF once it has
+// consumed every message sent before the Close, and this side may keep
+// reading until the peer closes too. Reset aborts both directions.
+type Stream struct {
+	id      uint64
+	session *Session
+
+	lock       sync.Mutex
+	cond       sync.Cond
+	queue      [][]byte
+	consumed   int // messages read since the last window update
+	sendWindow int
+	remoteDone bool // the peer closed its write side
+	localDone  bool // we closed our write side
+	drain      bool // the session ended, but queued messages can still be read
+	err        error
+}
+
+func newStream(s *Session, id uint64) *Stream {
+	st := &Stream{id: id, session: s}
+	st.cond.L = &st.lock
+	return st
+}
+
+// ID returns the stream ID.
+func (st *Stream) ID() uint64 {
+	return st.id
+}
+
+func (st *Stream) Write(msg []byte) (int, error) {
+	err := st.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// WriteMsg sends msg on the stream, blocking while the peer's receive window
+// is exhausted.
+func (st *Stream) WriteMsg(msg []byte) error {
+	st.lock.Lock()
+	for st.sendWindow == 0 && st.err == nil && !st.localDone {
+		st.cond.Wait()
+	}
+	if st.err != nil {
+		err := st.err
+		st.lock.Unlock()
+		return err
+	}
+	if st.localDone {
+		st.lock.Unlock()
+		return ErrStreamClosed
+	}
+	st.sendWindow--
+	st.lock.Unlock()
+
+	return st.session.writeFrame(st.id, flagData, msg)
+}
+
+// waitMsg blocks until a message is queued or the stream can't produce any
+// more. The caller must hold st.lock.
+func (st *Stream) waitMsg() error {
+	for {
+		if len(st.queue) > 0 {
+			return nil
+		}
+		if st.remoteDone && (st.err == nil || st.drain) {
+			return io.EOF
+		}
+		if st.err != nil {
+			return st.err
+		}
+		st.cond.Wait()
+	}
+}
+
+// pop removes the head of the queue and returns it along with the window
+// credit to hand back to the peer, if any. The caller must hold st.lock.
+func (st *Stream) pop() ([]byte, int) {
+	msg := st.queue[0]
+	st.queue[0] = nil
+	st.queue = st.queue[1:]
+
+	st.consumed++
+	if st.remoteDone || st.err != nil || st.consumed < max(st.session.window/2, 1) {
+		return msg, 0
+	}
+	grant := st.consumed
+	st.consumed = 0
+	return msg, grant
+}
+
+func (st *Stream) ReadMsg() ([]byte, error) {
+	st.lock.Lock()
+	if err := st.waitMsg(); err != nil {
+		st.lock.Unlock()
+		return nil, err
+	}
+	msg, grant := st.pop()
+	st.lock.Unlock()
+
+	if grant > 0 {
+		st.session.writeWindow(st.id, grant)
+	}
+	return msg, nil
+}
+
+func (st *Stream) Read(buf []byte) (int, error) {
+	st.lock.Lock()
+	if err := st.waitMsg(); err != nil {
+		st.lock.Unlock()
+		return 0, err
+	}
+	if len(st.queue[0]) > len(buf) {
+		st.lock.Unlock()
+		return 0, io.ErrShortBuffer
+	}
+	msg, grant := st.pop()
+	st.lock.Unlock()
+
+	n := copy(buf, msg)
+	st.ReleaseMsg(msg)
+	if grant > 0 {
+		st.session.writeWindow(st.id, grant)
+	}
+	return n, nil
+}
+
+// NextMsgLen blocks until a message is available and returns its length
+// without consuming it.
+func (st *Stream) NextMsgLen() (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if err := st.waitMsg(); err != nil {
+		return 0, err
+	}
+	return len(st.queue[0]), nil
+}
+
+func (st *Stream) ReleaseMsg(msg []byte) {
+	st.session.pool.Put(msg)
+}
+
+// Close closes the write side of the stream.
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	if st.localDone || st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localDone = true
+	finished := st.remoteDone
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	err := st.session.writeFrame(st.id, flagClose, nil)
+	if finished {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions and discards any unread
+// messages.
+func (st *Stream) Reset() error {
+	st.lock.Lock()
+	if st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+	st.setErr(ErrStreamReset)
+	st.lock.Unlock()
+
+	st.session.removeStream(st.id)
+	return st.session.writeFrame(st.id, flagReset, nil)
+}
+
+// setErr must be called with st.lock held.
+func (st *Stream) setErr(err error) {
+	st.err = err
+	for _, msg := range st.queue {
+		st.session.pool.Put(msg)
+	}
+	st.queue = nil
+	st.cond.Broadcast()
+}
+
+func (st *Stream) abort(err error) {
+	st.lock.Lock()
+	if st.err == nil {
+		st.setErr(err)
+	}
+	st.lock.Unlock()
+}
+
+// sessionFailed aborts the stream when the session ends with err. Messages
+// already received stay readable if the peer closed the stream or the
+// connection ended cleanly, since the peer sent them before it went away.
+func (st *Stream) sessionFailed(err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.err != nil {
+		return
+	}
+	if st.remoteDone || err == io.EOF {
+		st.err = err
+		st.drain = true
+		st.cond.Broadcast()
+		return
+	}
+	st.setErr(err)
+}
+
+// push queues a received message. It returns false if the peer overran the
+// receive window.
+func (st *Stream) push(msg []byte) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.err != nil || st.remoteDone {
+		st.session.pool.Put(msg)
+		return true
+	}
+	if len(st.queue) >= st.session.window {
+		return false
+	}
+	st.queue = append(st.queue, msg)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *Stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteDone = true
+	finished := st.localDone
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if finished {
+		st.session.removeStream(st.id)
+	}
+}
+
+// grant adds delta to the send window, and reports false if the window would
+// overflow, which no well-behaved peer can cause.
+func (st *Stream) grant(delta uint64) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if delta > uint64(math.MaxInt-st.sendWindow) {
+		return false
+	}
+	st.sendWindow += int(delta)
+	st.cond.Broadcast()
+	return true
+}
@@ -0,0 +1,209 @@
+package negotiate
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+)
+
+// Codec compresses messages one at a time.
+type Codec interface {
+	// Name identifies the codec during negotiation.
+	Name() string
+
+	// Compress appends the compressed msg to dst.
+	Compress(dst, msg []byte) ([]byte, error)
+
+	// Decompress appends the decompressed msg to dst. It fails with
+	// msgio.ErrMsgTooLarge if that would be more than maxSize bytes.
+	Decompress(dst, msg []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	// NoCompression sends messages as they are.
+	NoCompression Codec = noCompression{}
+
+	// Deflate compresses messages with DEFLATE at the default level.
+	Deflate Codec = &deflate{}
+)
+
+// maxFrameSize is the largest frame accepted for messages of up to maxSize
+// bytes, allowing for codecs that make incompressible messages larger.
+func maxFrameSize(maxSize int) int {
+	return maxSize + maxSize/4 + 1024
+}
+
+type noCompression struct{}
+
+func (noCompression) Name() string { return "none" }
+
+func (noCompression) Compress(dst, msg []byte) ([]byte, error) {
+	return append(dst, msg...), nil
+}
+
+func (noCompression) Decompress(dst, msg []byte, maxSize int) ([]byte, error) {
+	if len(msg) > maxSize {
+		return dst, msgio.ErrMsgTooLarge
+	}
+	return append(dst, msg...), nil
+}
+
+type deflate struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (*deflate) Name() string { return "deflate" }
+
+// appendWriter is an io.Writer appending to a slice.
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (d *deflate) Compress(dst, msg []byte) ([]byte, error) {
+	out := &appendWriter{buf: dst}
+	fw, _ := d.writers.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriter(out, flate.DefaultCompression)
+	} else {
+		fw.Reset(out)
+	}
+	defer d.writers.Put(fw)
+
+	if _, err := fw.Write(msg); err != nil {
+		return dst, err
+	}
+	if err := fw.Close(); err != nil {
+		return dst, err
+	}
+	return out.buf, nil
+}
+
+func (d *deflate) Decompress(dst, msg []byte, maxSize int) ([]byte, error) {
+	fr, _ := d.readers.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(bytes.NewReader(msg))
+	} else {
+		fr.(flate.Resetter).Reset(bytes.NewReader(msg), nil)
+	}
+	defer d.readers.Put(fr)
+
+	out := &appendWriter{buf: dst}
+	n, err := io.Copy(out, io.LimitReader(fr, int64(maxSize)+1))
+	if err != nil {
+		return dst, err
+	}
+	if n > int64(maxSize) {
+		return dst, msgio.ErrMsgTooLarge
+	}
+	return out.buf, nil
+}
+
+// compressWriter compresses messages before writing them.
+type compressWriter struct {
+	msgio.Writer
+	codec Codec
+}
+
+func (w *compressWriter) Write(msg []byte) (int, error) {
+	if err := w.WriteMsg(msg); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (w *compressWriter) WriteMsg(msg []byte) error {
+	buf := pool.Get(len(msg))
+	defer pool.Put(buf)
+	out, err := w.codec.Compress(buf[:0], msg)
+	if err != nil {
+		return err
+	}
+	return w.Writer.WriteMsg(out)
+}
+
+// decompressReader decompresses messages after reading them.
+type decompressReader struct {
+	msgio.Reader
+	codec Codec
+	max   int
+
+	lock sync.Mutex
+	next []byte // a decompressed message not consumed by Read yet
+}
+
+func (r *decompressReader) nextMsg() ([]byte, error) {
+	if r.next != nil {
+		return r.next, nil
+	}
+	msg, err := r.Reader.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Reader.ReleaseMsg(msg)
+
+	buf := pool.Get(min(2*len(msg), r.max))
+	out, err := r.codec.Decompress(buf[:0], msg, r.max)
+	if err != nil {
+		pool.Put(buf)
+		return nil, err
+	}
+	if out == nil {
+		out = []byte{}
+	}
+	r.next = out
+	return out, nil
+}
+
+func (r *decompressReader) NextMsgLen() (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (r *decompressReader) Read(buf []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	r.next = nil
+	n := copy(buf, msg)
+	pool.Put(msg)
+	return n, nil
+}
+
+func (r *decompressReader) ReadMsg() ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	msg, err := r.nextMsg()
+	if err != nil {
+		return nil, err
+	}
+	r.next = nil
+	return msg, nil
+}
+
+func (r *decompressReader) ReleaseMsg(msg []byte) {
+	pool.Put(msg)
+}
@@ -0,0 +1,306 @@
+// Package negotiate lets two peers agree on a framing, a compression codec
+// and a protocol version before exchanging messages.
+//
+// The exchange is modeled on multistream-select. Both sides speak uvarint
+// framing during negotiation. The client sends the protocol id followed by
+// a hello listing what it supports, in order of preference; the server
+// answers with its own protocol id and hello. Each side then picks, for
+// each list, the client's most preferred entry that the server supports,
+// so both settle on the same choice without another round trip, and
+// switches to it.
+package negotiate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+var (
+	// ErrBadHello is returned when the peer doesn't speak this protocol or
+	// sends a malformed hello.
+	ErrBadHello = errors.New("negotiate: malformed hello")
+
+	// ErrNoCommonFraming is returned when the peers share no framing.
+	ErrNoCommonFraming = errors.New("negotiate: no common framing")
+
+	// ErrNoCommonCodec is returned when the peers share no codec.
+	ErrNoCommonCodec = errors.New("negotiate: no common codec")
+
+	// ErrNoCommonVersion is returned when the peers share no protocol
+	// version.
+	ErrNoCommonVersion = errors.New("negotiate: no common version")
+)
+
+const (
+	protocolID = "/msgio/negotiate/1.0.0\n"
+
+	// maxHelloSize bounds the negotiation messages.
+	maxHelloSize = 4096
+
+	defaultMaxSize = 8 * 1024 * 1024 // 8mb
+)
+
+// Config configures one side of a negotiation. A nil Config uses the
+// defaults.
+type Config struct {
+	// Framings are the framings supported, most preferred first. Defaults
+	// to every framing registered with msgio.
+	Framings []msgio.Framing
+
+	// Codecs are the compression codecs supported, most preferred first.
+	// Defaults to NoCompression only.
+	Codecs []Codec
+
+	// Versions are the protocol versions supported, most preferred first.
+	// If neither side lists any, the negotiated version is empty.
+	Versions []string
+
+	// MaxMessageSize is the size of the largest message accepted after
+	// negotiation, once decompressed. Defaults to 8MiB.
+	MaxMessageSize int
+}
+
+// Conn is a negotiated connection. Messages written to it are compressed
+// with the negotiated codec and framed with the negotiated framing.
+type Conn struct {
+	msgio.Reader
+	msgio.Writer
+
+	rw      io.ReadWriter
+	framing msgio.Framing
+	codec   Codec
+	version string
+}
+
+// Client negotiates with the peer on rw and returns the configured
+// connection. The peer must call Server.
+func Client(rw io.ReadWriter, cfg *Config) (*Conn, error) {
+	return negotiate(rw, cfg, true)
+}
+
+// Server negotiates with the peer on rw and returns the configured
+// connection. The peer must call Client.
+func Server(rw io.ReadWriter, cfg *Config) (*Conn, error) {
+	return negotiate(rw, cfg, false)
+}
+
+// Framing returns the negotiated framing.
+func (c *Conn) Framing() msgio.Framing {
+	return c.framing
+}
+
+// Codec returns the negotiated compression codec.
+func (c *Conn) Codec() Codec {
+	return c.codec
+}
+
+// Version returns the negotiated protocol version.
+func (c *Conn) Version() string {
+	return c.version
+}
+
+// Close closes the underlying stream if it is an io.Closer.
+func (c *Conn) Close() error {
+	if cl, ok := c.rw.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// hello is what a side supports.
+type hello struct {
+	framings []string
+	codecs   []string
+	versions []string
+}
+
+func negotiate(rw io.ReadWriter, cfg *Config, client bool) (*Conn, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	framings := cfg.Framings
+	if len(framings) == 0 {
+		framings = msgio.Framings()
+	}
+	codecs := cfg.Codecs
+	if len(codecs) == 0 {
+		codecs = []Codec{NoCompression}
+	}
+	maxSize := cfg.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+
+	local := hello{versions: cfg.Versions}
+	for _, f := range framings {
+		local.framings = append(local.framings, f.Name())
+	}
+	for _, c := range codecs {
+		local.codecs = append(local.codecs, c.Name())
+	}
+	if err := local.validate(); err != nil {
+		return nil, err
+	}
+
+	// The hellos take turns, the client's first: if both sides wrote at
+	// once, neither would get to read on a transport without buffering.
+	w := msgio.NewVarintWriter(rw)
+	r := msgio.NewVarintReaderSize(rw, maxHelloSize)
+	var (
+		remote hello
+		err    error
+	)
+	if client {
+		if err := writeHello(w, local); err != nil {
+			return nil, err
+		}
+		if remote, err = readHello(r); err != nil {
+			return nil, err
+		}
+	} else {
+		if remote, err = readHello(r); err != nil {
+			return nil, err
+		}
+		if err := writeHello(w, local); err != nil {
+			return nil, err
+		}
+	}
+
+	clientHello, serverHello := local, remote
+	if !client {
+		clientHello, serverHello = remote, local
+	}
+	c := &Conn{rw: rw}
+
+	name, ok := choose(clientHello.framings, serverHello.framings)
+	if !ok {
+		return nil, ErrNoCommonFraming
+	}
+	for _, f := range framings {
+		if f.Name() == name {
+			c.framing = f
+		}
+	}
+
+	if name, ok = choose(clientHello.codecs, serverHello.codecs); !ok {
+		return nil, ErrNoCommonCodec
+	}
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			c.codec = codec
+		}
+	}
+
+	if len(clientHello.versions) > 0 || len(serverHello.versions) > 0 {
+		if c.version, ok = choose(clientHello.versions, serverHello.versions); !ok {
+			return nil, ErrNoCommonVersion
+		}
+	}
+
+	c.Writer = c.framing.NewWriter(rw)
+	if c.codec == NoCompression {
+		c.Reader = c.framing.NewReader(rw, maxSize)
+	} else {
+		c.Reader = &decompressReader{Reader: c.framing.NewReader(rw, maxFrameSize(maxSize)), codec: c.codec, max: maxSize}
+		c.Writer = &compressWriter{Writer: c.Writer, codec: c.codec}
+	}
+	return c, nil
+}
+
+// choose returns the first of the client's choices the server supports.
+func choose(client, server []string) (string, bool) {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c, true
+			}
+		}
+	}
+	return "", false
+}
+
+// The hello is a line per list, starting with the name of the list and
+// followed by its entries, separated by spaces. Unknown lists are ignored,
+// so that later versions can add some.
+const (
+	keyFramings = "framings"
+	keyCodecs   = "codecs"
+	keyVersions = "versions"
+)
+
+func (h hello) validate() error {
+	for _, list := range [][]string{h.framings, h.codecs, h.versions} {
+		for _, name := range list {
+			if name == "" || strings.ContainsAny(name, " \n") {
+				return fmt.Errorf("negotiate: invalid name %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+func writeHello(w msgio.Writer, h hello) error {
+	if err := w.WriteMsg([]byte(protocolID)); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, l := range []struct {
+		key  string
+		list []string
+	}{
+		{keyFramings, h.framings},
+		{keyCodecs, h.codecs},
+		{keyVersions, h.versions},
+	} {
+		buf.WriteString(l.key)
+		for _, name := range l.list {
+			buf.WriteByte(' ')
+			buf.WriteString(name)
+		}
+		buf.WriteByte('\n')
+	}
+	return w.WriteMsg(buf.Bytes())
+}
+
+func readHello(r msgio.Reader) (hello, error) {
+	var h hello
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return h, err
+	}
+	ok := string(msg) == protocolID
+	r.ReleaseMsg(msg)
+	if !ok {
+		return h, ErrBadHello
+	}
+
+	msg, err = r.ReadMsg()
+	if err != nil {
+		return h, err
+	}
+	defer r.ReleaseMsg(msg)
+	body := string(msg)
+	if !strings.HasSuffix(body, "\n") {
+		return h, ErrBadHello
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		fields := strings.Split(line, " ")
+		switch fields[0] {
+		case keyFramings:
+			h.framings = fields[1:]
+		case keyCodecs:
+			h.codecs = fields[1:]
+		case keyVersions:
+			h.versions = fields[1:]
+		}
+	}
+	if h.validate() != nil {
+		return h, ErrBadHello
+	}
+	return h, nil
+}
@@ -0,0 +1,172 @@
+package negotiate
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+type result struct {
+	conn *Conn
+	err  error
+}
+
+func negotiatePair(t *testing.T, client, server *Config) (*Conn, *Conn, error, error) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	done := make(chan result, 1)
+	go func() {
+		c, err := Server(b, server)
+		done <- result{c, err}
+	}()
+	c, err := Client(a, client)
+	if err != nil {
+		// unblock the server
+		a.Close()
+	}
+	res := <-done
+	return c, res.conn, err, res.err
+}
+
+func TestNegotiate(t *testing.T) {
+	client, server, cerr, serr := negotiatePair(t,
+		&Config{
+			Framings: []msgio.Framing{msgio.COBSFraming, msgio.VarintFraming, msgio.FixedFraming},
+			Codecs:   []Codec{Deflate, NoCompression},
+			Versions: []string{"/app/2", "/app/1"},
+		},
+		&Config{
+			Framings: []msgio.Framing{msgio.FixedFraming, msgio.VarintFraming},
+			Codecs:   []Codec{NoCompression, Deflate},
+			Versions: []string{"/app/1", "/app/2", "/app/3"},
+		},
+	)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	for _, c := range []*Conn{client, server} {
+		if c.Framing() != msgio.VarintFraming {
+			t.Fatalf("expected uvarint framing, got %s", c.Framing().Name())
+		}
+		if c.Codec() != Deflate {
+			t.Fatalf("expected deflate, got %s", c.Codec().Name())
+		}
+		if c.Version() != "/app/2" {
+			t.Fatalf("expected /app/2, got %s", c.Version())
+		}
+	}
+
+	msg := bytes.Repeat([]byte("compressible "), 100)
+	go client.WriteMsg(msg)
+	got, err := server.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("message corrupted")
+	}
+	server.ReleaseMsg(got)
+
+	go server.WriteMsg(nil)
+	buf := make([]byte, 10)
+	n, err := client.Read(buf)
+	if err != nil || n != 0 {
+		t.Fatalf("expected an empty message, got %d, %v", n, err)
+	}
+}
+
+func TestNegotiateDefaults(t *testing.T) {
+	client, server, cerr, serr := negotiatePair(t, nil, nil)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	if client.Framing() != msgio.Framings()[0] || server.Framing() != client.Framing() {
+		t.Fatalf("expected the first registered framing, got %s", client.Framing().Name())
+	}
+	if client.Codec() != NoCompression || client.Version() != "" {
+		t.Fatal("expected no compression and no version")
+	}
+
+	go client.WriteMsg([]byte("hello"))
+	got, err := server.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("expected hello, got %q", got)
+	}
+}
+
+func TestNegotiateNoCommon(t *testing.T) {
+	cases := []struct {
+		client, server *Config
+		err            error
+	}{
+		{
+			&Config{Framings: []msgio.Framing{msgio.FixedFraming}},
+			&Config{Framings: []msgio.Framing{msgio.VarintFraming}},
+			ErrNoCommonFraming,
+		},
+		{
+			&Config{Codecs: []Codec{Deflate}},
+			nil,
+			ErrNoCommonCodec,
+		},
+		{
+			&Config{Versions: []string{"/app/2"}},
+			nil,
+			ErrNoCommonVersion,
+		},
+	}
+	for _, c := range cases {
+		_, _, cerr, serr := negotiatePair(t, c.client, c.server)
+		if cerr != c.err || serr != c.err {
+			t.Fatalf("expected %v, got %v and %v", c.err, cerr, serr)
+		}
+	}
+}
+
+func TestNegotiateMaxSize(t *testing.T) {
+	cfg := &Config{Codecs: []Codec{Deflate}, MaxMessageSize: 100}
+	client, server, cerr, serr := negotiatePair(t, cfg, cfg)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	// compresses to well under the limit, but doesn't decompress under it
+	go client.WriteMsg(make([]byte, 1000))
+	if _, err := server.ReadMsg(); err != msgio.ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+}
+
+func TestNegotiateMaxSizeUncompressed(t *testing.T) {
+	for _, f := range msgio.Framings() {
+		t.Run(f.Name(), func(t *testing.T) {
+			cfg := &Config{Framings: []msgio.Framing{f}, MaxMessageSize: 100}
+			client, server, cerr, serr := negotiatePair(t, cfg, cfg)
+			if cerr != nil || serr != nil {
+				t.Fatal(cerr, serr)
+			}
+			go client.WriteMsg(bytes.Repeat([]byte("x"), 120))
+			if _, err := server.ReadMsg(); err != msgio.ErrMsgTooLarge {
+				t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBadHello(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go msgio.NewVarintWriter(a).WriteMsg([]byte("/multistream/1.0.0\n"))
+	if _, err := Server(b, nil); err != ErrBadHello {
+		t.Fatalf("expected ErrBadHello, got %v", err)
+	}
+}
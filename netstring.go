@@ -0,0 +1,262 @@
+package msgio
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// ErrInvalidNetstring is returned when reading a malformed netstring.
+var ErrInvalidNetstring = errors.New("invalid netstring")
+
+// maxNetstringDigits bounds the length prefix, which is plenty for any
+// message size a reader accepts.
+const maxNetstringDigits = 10
+
+// NetstringFraming is the framing written by NewNetstringWriter.
+var NetstringFraming Framing = netstringFraming{}
+
+type netstringFraming struct{}
+
+func (netstringFraming) Name() string { return "netstring" }
+
+func (netstringFraming) NewReader(r io.Reader, maxSize int) ReadCloser {
+	return NewNetstringReaderSize(r, maxSize)
+}
+
+func (netstringFraming) NewWriter(w io.Writer) WriteCloser {
+	return NewNetstringWriter(w)
+}
+
+func (netstringFraming) frameSize(r io.Reader) (int, int, error) {
+	n, digits, err := readNetstringLen(&simpleByteReader{R: r})
+	if err != nil {
+		return 0, 0, err
+	}
+	return digits + 1, n + 1, nil
+}
+
+// readNetstringLen reads a netstring's length and the colon after it, and
+// returns the length and the number of digits.
+func readNetstringLen(br io.ByteReader) (int, int, error) {
+	n, digits := 0, 0
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF && digits > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, err
+		}
+		switch {
+		case b == ':' && digits > 0:
+			return n, digits, nil
+		case b < '0' || b > '9':
+			return 0, 0, ErrInvalidNetstring
+		case digits == maxNetstringDigits:
+			return 0, 0, ErrInvalidNetstring
+		case digits == 1 && n == 0:
+			return 0, 0, ErrInvalidNetstring // leading zero
+		}
+		n = n*10 + int(b-'0')
+		digits++
+	}
+}
+
+// netstringWriter is the underlying type that implements the Writer
+// interface.
+type netstringWriter struct {
+	W io.Writer
+
+	pool *pool.BufferPool
+	lock sync.Mutex
+}
+
+// NewNetstringWriter wraps an io.Writer with a msgio framed writer that
+// writes every message as a netstring: its decimal length, a colon, the
+// message and a comma, as in "5:hello,".
+func NewNetstringWriter(w io.Writer) WriteCloser {
+	return NewNetstringWriterWithPool(w, pool.GlobalPool)
+}
+
+// NewNetstringWriterWithPool is the same as NewNetstringWriter but allows
+// one to specify a buffer pool.
+func NewNetstringWriterWithPool(w io.Writer, p *pool.BufferPool) WriteCloser {
+	if p == nil {
+		panic("nil pool")
+	}
+	return &netstringWriter{W: w, pool: p}
+}
+
+func (s *netstringWriter) Write(msg []byte) (int, error) {
+	err := s.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *netstringWriter) WriteMsg(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf := s.pool.Get(len(msg) + maxNetstringDigits + 2)
+	n := len(strconv.AppendInt(buf[:0], int64(len(msg)), 10))
+	buf[n] = ':'
+	n++
+	n += copy(buf[n:], msg)
+	buf[n] = ','
+	_, err := s.W.Write(buf[:n+1])
+	s.pool.Put(buf)
+
+	return err
+}
+
+func (s *netstringWriter) Close() error {
+	if c, ok := s.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// netstringReader is the underlying type that implements the Reader
+// interface.
+type netstringReader struct {
+	R  io.Reader
+	br io.ByteReader // for reading lengths and commas.
+
+	next int
+	pool *pool.BufferPool
+	lock sync.Mutex
+	max  int // the maximal message size (in bytes) this reader handles
+}
+
+// NewNetstringReader wraps an io.Reader with a msgio framed reader for
+// netstrings, see NewNetstringWriter.
+func NewNetstringReader(r io.Reader) ReadCloser {
+	return NewNetstringReaderSize(r, defaultMaxSize)
+}
+
+// NewNetstringReaderSize is equivalent to NewNetstringReader but allows one
+// to specify a max message size.
+func NewNetstringReaderSize(r io.Reader, maxMessageSize int) ReadCloser {
+	return NewNetstringReaderSizeWithPool(r, maxMessageSize, pool.GlobalPool)
+}
+
+// NewNetstringReaderWithPool is the same as NewNetstringReader but allows
+// one to specify a buffer pool.
+func NewNetstringReaderWithPool(r io.Reader, p *pool.BufferPool) ReadCloser {
+	return NewNetstringReaderSizeWithPool(r, defaultMaxSize, p)
+}
+
+// NewNetstringReaderSizeWithPool is the same as NewNetstringReader but
+// allows one to specify a buffer pool and a max message size.
+func NewNetstringReaderSizeWithPool(r io.Reader, maxMessageSize int, p *pool.BufferPool) ReadCloser {
+	if p == nil {
+		panic("nil pool")
+	}
+	return &netstringReader{
+		R:    r,
+		br:   &simpleByteReader{R: r},
+		next: -1,
+		pool: p,
+		max:  maxMessageSize,
+	}
+}
+
+// NextMsgLen reads the length of the next msg and returns it.
+// WARNING: like Read, NextMsgLen is destructive. It reads from the internal
+// reader.
+func (s *netstringReader) NextMsgLen() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nextMsgLen()
+}
+
+func (s *netstringReader) nextMsgLen() (int, error) {
+	if s.next == -1 {
+		length, _, err := readNetstringLen(s.br)
+		if err != nil {
+			return 0, err
+		}
+		s.next = length
+	}
+	return s.next, nil
+}
+
+// readComma consumes the comma ending a netstring.
+func (s *netstringReader) readComma() error {
+	b, err := s.br.ReadByte()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err == nil && b != ',' {
+		err = ErrInvalidNetstring
+	}
+	return err
+}
+
+func (s *netstringReader) Read(msg []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	length, err := s.nextMsgLen()
+	if err != nil {
+		return 0, err
+	}
+
+	if length > len(msg) {
+		return 0, io.ErrShortBuffer
+	}
+	_, err = io.ReadFull(s.R, msg[:length])
+	s.next = -1 // signal we've consumed this msg
+	if err == nil {
+		err = s.readComma()
+	}
+	return length, err
+}
+
+func (s *netstringReader) ReadMsg() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	length, err := s.nextMsgLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if length > s.max {
+		return nil, ErrMsgTooLarge
+	}
+
+	msg := s.pool.Get(length)
+	_, err = io.ReadFull(s.R, msg)
+	s.next = -1 // signal we've consumed this msg
+	if err == nil {
+		err = s.readComma()
+	}
+	return msg, err
+}
+
+func (s *netstringReader) ReleaseMsg(msg []byte) {
+	s.pool.Put(msg)
+}
+
+func (s *netstringReader) Close() error {
+	if c, ok := s.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewNetstringReadWriter wraps an io.ReadWriter with a msgio.ReadWriter
+// using netstring framing.
+func NewNetstringReadWriter(rw io.ReadWriter) ReadWriteCloser {
+	return &readWriter{
+		Reader: NewNetstringReader(rw),
+		Writer: NewNetstringWriter(rw),
+	}
+}
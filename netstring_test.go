@@ -0,0 +1,72 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestNetstringFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewNetstringWriter(buf)
+	w.WriteMsg([]byte("hello world!"))
+	w.WriteMsg(nil)
+	if buf.String() != "12:hello world!,0:," {
+		t.Fatalf("unexpected encoding %q", buf.String())
+	}
+
+	r := NewNetstringReader(buf)
+	expectMsgs(t, r, "hello world!", "")
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestNetstringInvalid(t *testing.T) {
+	for _, s := range []string{
+		"5:hello;",
+		"05:hello,",
+		":hello,",
+		"x:,",
+		"12345678901:",
+	} {
+		r := NewNetstringReader(bytes.NewReader([]byte(s)))
+		if _, err := r.ReadMsg(); err != ErrInvalidNetstring {
+			t.Errorf("%q: expected ErrInvalidNetstring, got %v", s, err)
+		}
+	}
+
+	r := NewNetstringReader(bytes.NewReader([]byte("5:hel")))
+	if _, err := r.ReadMsg(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestNetstringMaxSize(t *testing.T) {
+	r := NewNetstringReaderSize(bytes.NewReader([]byte("5:hello,")), 4)
+	if _, err := r.ReadMsg(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+}
+
+func TestNetstringReadWriter(t *testing.T) {
+	a, b := net.Pipe()
+	ra, rb := NewNetstringReadWriter(a), NewNetstringReadWriter(b)
+	defer ra.Close()
+	defer rb.Close()
+
+	go ra.WriteMsg([]byte("ping"))
+	buf := make([]byte, 2)
+	if _, err := rb.Read(buf); err != io.ErrShortBuffer {
+		t.Fatalf("expected ErrShortBuffer, got %v", err)
+	}
+	buf = make([]byte, 10)
+	n, err := rb.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("expected ping, got %q", buf[:n])
+	}
+}
@@ -0,0 +1,221 @@
+package msgio
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting both the byte rate and the message rate
+// of the readers and writers it is attached to. A single Limiter may be
+// shared by any number of them to cap their combined rate.
+type Limiter struct {
+	bytes *bucket
+	msgs  *bucket
+}
+
+// NewLimiter returns a Limiter allowing bytesPerSec payload bytes and
+// msgsPerSec messages per second, with bursts of up to byteBurst bytes and
+// msgBurst messages. A rate of zero or less disables that limit.
+//
+// Messages larger than byteBurst are still allowed through: they consume
+// credit in advance and delay the messages that follow.
+func NewLimiter(bytesPerSec, byteBurst, msgsPerSec, msgBurst int) *Limiter {
+	return &Limiter{
+		bytes: newBucket(bytesPerSec, byteBurst),
+		msgs:  newBucket(msgsPerSec, msgBurst),
+	}
+}
+
+// Wait blocks until a message of n bytes may pass, or until ctx is done.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d := max(l.bytes.reserve(n), l.msgs.reserve(1))
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.bytes.refund(n)
+		l.msgs.refund(1)
+		return ctx.Err()
+	}
+}
+
+type bucket struct {
+	lock   sync.Mutex
+	rate   float64 // tokens per second, or 0 for unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst int) *bucket {
+	if rate <= 0 {
+		return &bucket{}
+	}
+	burst = max(burst, 1)
+	return &bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// the caller must wait before the debt is paid off.
+func (b *bucket) reserve(n int) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund returns tokens taken by a reservation that was abandoned.
+func (b *bucket) refund(n int) {
+	if b.rate == 0 {
+		return
+	}
+	b.lock.Lock()
+	b.tokens = min(b.burst, b.tokens+float64(n))
+	b.lock.Unlock()
+}
+
+// RateLimitedReader is a ReadCloser whose reads are paced by a Limiter.
+type RateLimitedReader struct {
+	R       ReadCloser
+	limiter *Limiter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewRateLimitedReader wraps r so that messages are only consumed from it
+// as fast as l allows. The length of each message is peeked before waiting,
+// so a throttled peer is pushed back on by the transport rather than
+// buffered.
+func NewRateLimitedReader(r ReadCloser, l *Limiter) *RateLimitedReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RateLimitedReader{R: r, limiter: l, ctx: ctx, cancel: cancel}
+}
+
+func (s *RateLimitedReader) wait(ctx context.Context) error {
+	n, err := s.R.NextMsgLen()
+	if err != nil {
+		return err
+	}
+	return waitClosable(ctx, s.ctx, s.limiter, n)
+}
+
+func (s *RateLimitedReader) Read(msg []byte) (int, error) {
+	if err := s.wait(context.Background()); err != nil {
+		return 0, err
+	}
+	return s.R.Read(msg)
+}
+
+func (s *RateLimitedReader) ReadMsg() ([]byte, error) {
+	return s.ReadMsgContext(context.Background())
+}
+
+// ReadMsgContext is like ReadMsg but gives up waiting for the limiter when
+// ctx is done.
+func (s *RateLimitedReader) ReadMsgContext(ctx context.Context) ([]byte, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.R.ReadMsg()
+}
+
+func (s *RateLimitedReader) ReleaseMsg(msg []byte) {
+	s.R.ReleaseMsg(msg)
+}
+
+func (s *RateLimitedReader) NextMsgLen() (int, error) {
+	return s.R.NextMsgLen()
+}
+
+// Close aborts pending waits and closes the wrapped reader.
+func (s *RateLimitedReader) Close() error {
+	s.cancel()
+	return s.R.Close()
+}
+
+// RateLimitedWriter is a WriteCloser whose writes are paced by a Limiter.
+type RateLimitedWriter struct {
+	W       WriteCloser
+	limiter *Limiter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewRateLimitedWriter wraps w so that messages are only written as fast as
+// l allows.
+func NewRateLimitedWriter(w WriteCloser, l *Limiter) *RateLimitedWriter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RateLimitedWriter{W: w, limiter: l, ctx: ctx, cancel: cancel}
+}
+
+func (s *RateLimitedWriter) Write(msg []byte) (int, error) {
+	err := s.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *RateLimitedWriter) WriteMsg(msg []byte) error {
+	return s.WriteMsgContext(context.Background(), msg)
+}
+
+// WriteMsgContext is like WriteMsg but gives up waiting for the limiter when
+// ctx is done.
+func (s *RateLimitedWriter) WriteMsgContext(ctx context.Context, msg []byte) error {
+	if err := waitClosable(ctx, s.ctx, s.limiter, len(msg)); err != nil {
+		return err
+	}
+	return s.W.WriteMsg(msg)
+}
+
+// Close aborts pending waits and closes the wrapped writer.
+func (s *RateLimitedWriter) Close() error {
+	s.cancel()
+	return s.W.Close()
+}
+
+// waitClosable waits on l until ctx is done or the wrapper owning closed is
+// closed, in which case it returns io.ErrClosedPipe.
+func waitClosable(ctx, closed context.Context, l *Limiter, n int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(closed, cancel)
+	defer stop()
+
+	err := l.Wait(ctx, n)
+	if err != nil && closed.Err() != nil {
+		return io.ErrClosedPipe
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package msgio
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedWriterMessages(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l := NewLimiter(0, 0, 100, 1)
+	w := NewRateLimitedWriter(NewWriter(buf), l)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := w.WriteMsg([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first message is covered by the burst, the next five take 10ms each
+	if d := time.Since(start); d < 45*time.Millisecond {
+		t.Fatalf("writes were not limited: %s", d)
+	}
+
+	r := NewReader(buf)
+	for i := 0; i < 6; i++ {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "hello" {
+			t.Fatalf("expected hello, got %q", msg)
+		}
+	}
+}
+
+func TestRateLimitedReaderBytes(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := NewWriter(buf)
+	for i := 0; i < 4; i++ {
+		if err := w.WriteMsg(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a single message larger than the burst is still let through
+	l := NewLimiter(10000, 50, 0, 0)
+	r := NewRateLimitedReader(NewReader(buf), l)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg) != 100 {
+			t.Fatalf("expected 100 bytes, got %d", len(msg))
+		}
+		r.ReleaseMsg(msg)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("reads were not limited: %s", d)
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestRateLimitedContext(t *testing.T) {
+	l := NewLimiter(0, 0, 1, 1)
+	w := NewRateLimitedWriter(NewWriter(bytes.NewBuffer(nil)), l)
+
+	if err := w.WriteMsg(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.WriteMsgContext(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- w.WriteMsg(nil) }()
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, got %v", err)
+	}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	l := NewLimiter(0, 0, 100, 1)
+	w1 := NewRateLimitedWriter(NewWriter(bytes.NewBuffer(nil)), l)
+	w2 := NewRateLimitedWriter(NewWriter(bytes.NewBuffer(nil)), l)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := w1.WriteMsg(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := w2.WriteMsg(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 45*time.Millisecond {
+		t.Fatalf("writers did not share the limit: %s", d)
+	}
+}
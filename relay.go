@@ -0,0 +1,114 @@
+package msgio
+
+import (
+	"io"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+const relayChunkSize = 32 * 1024
+
+// Relay copies messages from src to dst until src returns io.EOF, and
+// returns the number of payload bytes relayed. Only one message is held at
+// a time, in src's pooled buffer, and it is released as soon as it has been
+// written.
+//
+// Because messages are re-framed by dst, Relay also converts between
+// framings. For example, to forward a uint32-framed stream to a
+// varint-framed peer while rejecting messages over 1MiB:
+//
+//	Relay(NewVarintWriter(peer), NewReaderSize(client, 1<<20))
+func Relay(dst Writer, src Reader) (int64, error) {
+	var n int64
+	for {
+		msg, err := src.ReadMsg()
+		if err != nil {
+			src.ReleaseMsg(msg)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		err = dst.WriteMsg(msg)
+		src.ReleaseMsg(msg)
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(msg))
+	}
+}
+
+// writeTo implements io.WriterTo for Readers. Messages are relayed frame by
+// frame to a msgio Writer; any other io.Writer receives the bare payloads.
+func writeTo(w io.Writer, r Reader) (int64, error) {
+	if mw, ok := w.(Writer); ok {
+		return Relay(mw, r)
+	}
+
+	var n int64
+	for {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			r.ReleaseMsg(msg)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		written, err := w.Write(msg)
+		r.ReleaseMsg(msg)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// readFrom implements io.ReaderFrom for Writers. Messages from a msgio
+// Reader are relayed frame by frame; from any other io.Reader, every chunk
+// returned by Read is written as one message, as io.Copy would.
+func readFrom(w Writer, r io.Reader) (int64, error) {
+	if mr, ok := r.(Reader); ok {
+		return Relay(w, mr)
+	}
+
+	buf := pool.Get(relayChunkSize)
+	defer pool.Put(buf)
+
+	var n int64
+	for {
+		read, err := r.Read(buf)
+		if read > 0 {
+			if werr := w.WriteMsg(buf[:read]); werr != nil {
+				return n, werr
+			}
+			n += int64(read)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, see Relay.
+func (s *reader) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, s)
+}
+
+// ReadFrom implements io.ReaderFrom, see Relay.
+func (s *writer) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(s, r)
+}
+
+// WriteTo implements io.WriterTo, see Relay.
+func (s *varintReader) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, s)
+}
+
+// ReadFrom implements io.ReaderFrom, see Relay.
+func (s *varintWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(s, r)
+}
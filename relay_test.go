@@ -0,0 +1,89 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRelayConvertsFraming(t *testing.T) {
+	src := new(bytes.Buffer)
+	w := NewWriter(src)
+	msgs := []string{"hello", "", "world"}
+	for _, m := range msgs {
+		w.WriteMsg([]byte(m))
+	}
+
+	dst := new(bytes.Buffer)
+	n, err := Relay(NewVarintWriter(dst), NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 bytes relayed, got %d", n)
+	}
+
+	r := NewVarintReader(dst)
+	for _, m := range msgs {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Fatalf("expected %q, got %q", m, msg)
+		}
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestRelayMaxSize(t *testing.T) {
+	src := new(bytes.Buffer)
+	w := NewVarintWriter(src)
+	w.WriteMsg([]byte("ok"))
+	w.WriteMsg([]byte("too large"))
+
+	dst := new(bytes.Buffer)
+	n, err := Relay(NewWriter(dst), NewVarintReaderSize(src, 4))
+	if err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 bytes relayed, got %d", n)
+	}
+}
+
+func TestIoCopy(t *testing.T) {
+	src := new(bytes.Buffer)
+	w := NewVarintWriter(src)
+	w.WriteMsg([]byte("hello"))
+	w.WriteMsg([]byte("world"))
+
+	// frame to frame goes through WriterTo
+	dst := new(bytes.Buffer)
+	if _, err := io.Copy(NewWriter(dst), NewVarintReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	if _, err := io.Copy(&plain, NewReader(dst)); err != nil {
+		t.Fatal(err)
+	}
+	if plain.String() != "helloworld" {
+		t.Fatalf("expected helloworld, got %q", plain.String())
+	}
+
+	// a plain reader is framed chunk by chunk through ReaderFrom
+	framed := new(bytes.Buffer)
+	if _, err := io.Copy(NewWriter(framed), strings.NewReader("payload")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewReader(framed).ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "payload" {
+		t.Fatalf("expected payload, got %q", msg)
+	}
+}
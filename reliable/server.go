@@ -0,0 +1,159 @@
+package reliable
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-varint"
+)
+
+// Token identifies a session to resume. The zero Token asks for a new one.
+type Token [16]byte
+
+func (t Token) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+const (
+	statusOK byte = iota
+	statusUnknown
+)
+
+// Server accepts sessions, and keeps them until they end so that clients
+// can resume them.
+type Server struct {
+	cfg *Config
+
+	lock     sync.Mutex
+	sessions map[Token]*Session
+}
+
+// NewServer returns a Server creating sessions with cfg.
+func NewServer(cfg *Config) *Server {
+	return &Server{cfg: cfg, sessions: make(map[Token]*Session)}
+}
+
+// Accept runs the handshake on rw, a new connection from a client. It
+// returns the session the client asked for, and whether it is resumed: a
+// resumed session carries on over rw, so the goroutines already using it
+// don't need to know. Resuming a session that ended or expired fails with
+// ErrUnknownSession.
+func (srv *Server) Accept(rw msgio.ReadWriteCloser) (*Session, bool, error) {
+	token, recvd, err := readHello(rw)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if token == (Token{}) {
+		if _, err := rand.Read(token[:]); err != nil {
+			return nil, false, err
+		}
+		s := newSession(token, srv.cfg, false)
+		s.onClose = func() { srv.remove(token) }
+		srv.lock.Lock()
+		srv.sessions[token] = s
+		srv.lock.Unlock()
+
+		if err := writeReply(rw, statusOK, token, 0); err != nil {
+			s.fail(err)
+			return nil, false, err
+		}
+		if err := s.attach(rw, recvd); err != nil {
+			s.fail(err)
+			return nil, false, err
+		}
+		return s, false, nil
+	}
+
+	srv.lock.Lock()
+	s := srv.sessions[token]
+	srv.lock.Unlock()
+	if s == nil {
+		writeReply(rw, statusUnknown, token, 0)
+		return nil, false, ErrUnknownSession
+	}
+
+	s.attachLock.Lock()
+	defer s.attachLock.Unlock()
+	ourRecvd, err := s.detach()
+	if err != nil {
+		writeReply(rw, statusUnknown, token, 0)
+		return nil, false, ErrUnknownSession
+	}
+	if err := writeReply(rw, statusOK, token, ourRecvd); err != nil {
+		return nil, false, err
+	}
+	if err := s.attach(rw, recvd); err != nil {
+		return nil, false, err
+	}
+	return s, true, nil
+}
+
+// Len returns the number of sessions the server keeps.
+func (srv *Server) Len() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return len(srv.sessions)
+}
+
+func (srv *Server) remove(token Token) {
+	srv.lock.Lock()
+	delete(srv.sessions, token)
+	srv.lock.Unlock()
+}
+
+func writeHello(w msgio.Writer, token Token, recvd uint64) error {
+	buf := append(token[:], varint.ToUvarint(recvd)...)
+	return w.WriteMsg(buf)
+}
+
+func readHello(r msgio.Reader) (Token, uint64, error) {
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return Token{}, 0, err
+	}
+	defer r.ReleaseMsg(msg)
+	return parseHello(msg)
+}
+
+func parseHello(msg []byte) (Token, uint64, error) {
+	var token Token
+	if len(msg) < len(token) {
+		return token, 0, ErrProtocol
+	}
+	copy(token[:], msg)
+	recvd, n, err := varint.FromUvarint(msg[len(token):])
+	if err != nil || len(token)+n != len(msg) {
+		return token, 0, ErrProtocol
+	}
+	return token, recvd, nil
+}
+
+func writeReply(w msgio.Writer, status byte, token Token, recvd uint64) error {
+	buf := append([]byte{status}, token[:]...)
+	buf = append(buf, varint.ToUvarint(recvd)...)
+	return w.WriteMsg(buf)
+}
+
+// readReply reads the server's answer to a hello, which is a status byte
+// followed by a hello.
+func readReply(r msgio.Reader) (Token, uint64, error) {
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return Token{}, 0, err
+	}
+	defer r.ReleaseMsg(msg)
+	if len(msg) == 0 {
+		return Token{}, 0, ErrProtocol
+	}
+	switch msg[0] {
+	case statusOK:
+		return parseHello(msg[1:])
+	case statusUnknown:
+		return Token{}, 0, ErrUnknownSession
+	default:
+		return Token{}, 0, ErrProtocol
+	}
+}
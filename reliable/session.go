@@ -0,0 +1,674 @@
+// Package reliable provides sessions that survive reconnects over
+// msgio.ReadWriteClosers.
+//
+// Every message sent on a session gets a sequence number and is kept in a
+// replay buffer until the peer acknowledges it. Acknowledgments are sent
+// periodically, and are cumulative: they carry the sequence number of the
+// last message received. When the connection drops, the client reconnects
+// and resumes the session with its token; both sides then tell each other
+// the last sequence number they received, and send again whatever the
+// other side missed.
+//
+// Each connection starts with a handshake, client first: the client sends
+// its token, zero for a new session, and the last sequence number it
+// received. The server answers with a status byte, the token and its own
+// last received sequence number. Every frame after that starts with a type
+// byte: data frames carry a uvarint sequence number and the payload, ack
+// frames a uvarint sequence number, and close frames nothing.
+package reliable
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-varint"
+)
+
+var (
+	// ErrSessionClosed is returned when using a session that has been
+	// closed.
+	ErrSessionClosed = errors.New("reliable: session closed")
+
+	// ErrSessionExpired is returned when using a session that wasn't
+	// resumed within its resume timeout.
+	ErrSessionExpired = errors.New("reliable: session expired")
+
+	// ErrUnknownSession is returned when resuming a session the server
+	// doesn't know, or no longer knows.
+	ErrUnknownSession = errors.New("reliable: unknown session")
+
+	// ErrProtocol is returned when the peer violates the protocol.
+	ErrProtocol = errors.New("reliable: protocol error")
+
+	// ErrNotClient is returned when resuming a session from the server
+	// side. Servers resume sessions in Accept.
+	ErrNotClient = errors.New("reliable: only clients resume sessions")
+)
+
+const (
+	frameData byte = iota
+	frameAck
+	frameClose
+)
+
+const (
+	defaultAckInterval   = 200 * time.Millisecond
+	defaultAckEvery      = 32
+	defaultReplayBuffer  = 256
+	defaultReceiveBuffer = 256
+	defaultResumeTimeout = time.Minute
+)
+
+// Config configures a Session. A nil Config uses the defaults.
+type Config struct {
+	// AckInterval is how often received messages are acknowledged.
+	// Defaults to 200ms.
+	AckInterval time.Duration
+
+	// AckEvery is the number of received messages after which they are
+	// acknowledged without waiting for AckInterval. Defaults to 32.
+	AckEvery int
+
+	// ReplayBuffer is the number of unacknowledged messages kept. Writes
+	// block while it is full. Defaults to 256.
+	ReplayBuffer int
+
+	// ReceiveBuffer is the number of received messages acknowledged before
+	// the application reads them. Messages received past it are buffered
+	// but not acknowledged, which blocks the peer once its replay buffer
+	// fills. Defaults to 256.
+	ReceiveBuffer int
+
+	// ResumeTimeout is how long a session waits to be resumed after its
+	// connection drops, before failing with ErrSessionExpired. Defaults
+	// to one minute.
+	ResumeTimeout time.Duration
+}
+
+func (cfg *Config) withDefaults() Config {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.AckInterval <= 0 {
+		c.AckInterval = defaultAckInterval
+	}
+	if c.AckEvery <= 0 {
+		c.AckEvery = defaultAckEvery
+	}
+	if c.ReplayBuffer <= 0 {
+		c.ReplayBuffer = defaultReplayBuffer
+	}
+	if c.ReceiveBuffer <= 0 {
+		c.ReceiveBuffer = defaultReceiveBuffer
+	}
+	if c.ResumeTimeout <= 0 {
+		c.ResumeTimeout = defaultResumeTimeout
+	}
+	return c
+}
+
+// Session is a reliable message session. Its messages are delivered once
+// and in order across reconnects, as long as the session is resumed within
+// its resume timeout.
+//
+// While the session is disconnected, reads block and writes are buffered
+// until the replay buffer is full.
+type Session struct {
+	token  Token
+	cfg    Config
+	client bool
+	pool   *pool.BufferPool
+
+	onClose func() // called once the session fails
+
+	// wlock orders data frames: it is held from assigning a sequence
+	// number until the frame is written, and while resending frames.
+	wlock sync.Mutex
+
+	// attachLock serializes resumptions.
+	attachLock sync.Mutex
+
+	lock     sync.Mutex
+	space    *sync.Cond // signaled when the replay buffer shrinks or the session fails
+	conn     *conn      // nil while disconnected
+	loopDone chan struct{}
+	sent     uint64     // last sequence number sent
+	acked    uint64     // last sequence number acknowledged by the peer
+	replay   [][]byte   // frames acked+1 to sent
+	recvd    uint64     // last sequence number received
+	received *sync.Cond // signaled when a message is queued or the session fails
+	queue    [][]byte   // received messages not read yet
+	consumed uint64     // last sequence number read by the application
+	expiry   *time.Timer
+	err      error
+
+	rlock  sync.Mutex
+	next   []byte // a message peeked by NextMsgLen or a short Read
+	closed chan struct{}
+}
+
+// conn is one connection of a session.
+type conn struct {
+	rw      msgio.ReadWriteCloser
+	wlock   sync.Mutex
+	dead    chan struct{}
+	once    sync.Once
+	done    chan struct{} // closed when the read loop returns
+	ackNow  chan struct{}
+	lastAck atomic.Uint64 // last sequence number acknowledged to the peer
+}
+
+func newSession(token Token, cfg *Config, client bool) *Session {
+	s := &Session{
+		token:  token,
+		cfg:    cfg.withDefaults(),
+		client: client,
+		pool:   pool.GlobalPool,
+		closed: make(chan struct{}),
+	}
+	s.space = sync.NewCond(&s.lock)
+	s.received = sync.NewCond(&s.lock)
+	return s
+}
+
+// Client starts a new session over rw.
+func Client(rw msgio.ReadWriteCloser, cfg *Config) (*Session, error) {
+	if err := writeHello(rw, Token{}, 0); err != nil {
+		return nil, err
+	}
+	token, peerRecvd, err := readReply(rw)
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(token, cfg, true)
+	if err := s.attach(rw, peerRecvd); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Resume resumes the session over rw, a new connection to the same server.
+// The previous connection is closed if it is still open. Messages the
+// server missed are sent again.
+func (s *Session) Resume(rw msgio.ReadWriteCloser) error {
+	if !s.client {
+		return ErrNotClient
+	}
+	s.attachLock.Lock()
+	defer s.attachLock.Unlock()
+
+	recvd, err := s.detach()
+	if err != nil {
+		return err
+	}
+	if err := writeHello(rw, s.token, recvd); err != nil {
+		return err
+	}
+	token, peerRecvd, err := readReply(rw)
+	if err != nil {
+		return err
+	}
+	if token != s.token {
+		return ErrProtocol
+	}
+	return s.attach(rw, peerRecvd)
+}
+
+// Token returns the token that identifies the session.
+func (s *Session) Token() Token {
+	return s.token
+}
+
+// Disconnected returns a channel that is closed once the current connection
+// drops, or a closed channel if the session is disconnected. Clients should
+// then Resume the session.
+func (s *Session) Disconnected() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		return closedChan
+	}
+	return s.conn.dead
+}
+
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Done returns a channel that is closed once the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns the error that ended the session, if any. It is io.EOF if
+// the peer closed the session.
+func (s *Session) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Unacked returns the number of messages sent but not acknowledged yet.
+func (s *Session) Unacked() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.replay)
+}
+
+// detach closes the current connection and waits for its read loop, and
+// returns the last sequence number received.
+func (s *Session) detach() (uint64, error) {
+	s.lock.Lock()
+	c, done := s.conn, s.loopDone
+	s.lock.Unlock()
+	if c != nil {
+		c.kill()
+	}
+	if done != nil {
+		<-done
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.recvd, s.err
+}
+
+// attach starts using rw, once the handshake says the peer received up to
+// peerRecvd, and sends again the frames after that. The frames are shared
+// with the replay buffer, so acknowledging them mustn't clear them.
+func (s *Session) attach(rw msgio.ReadWriteCloser, peerRecvd uint64) error {
+	s.wlock.Lock()
+	s.lock.Lock()
+	if s.err != nil {
+		err := s.err
+		s.lock.Unlock()
+		s.wlock.Unlock()
+		rw.Close()
+		return err
+	}
+	if peerRecvd < s.acked || peerRecvd > s.sent {
+		s.lock.Unlock()
+		s.wlock.Unlock()
+		rw.Close()
+		return ErrProtocol
+	}
+	s.ack(peerRecvd)
+	c := &conn{
+		rw:     rw,
+		dead:   make(chan struct{}),
+		done:   make(chan struct{}),
+		ackNow: make(chan struct{}, 1),
+	}
+	c.lastAck.Store(s.recvd)
+	s.conn, s.loopDone = c, c.done
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	resend := s.replay
+	s.lock.Unlock()
+
+	go s.readLoop(c)
+	go s.ackLoop(c)
+
+	// Resend in the background, as the peer may not read until we return,
+	// holding wlock so that new messages go after.
+	go func() {
+		defer s.wlock.Unlock()
+		for _, frame := range resend {
+			if err := c.write(frame); err != nil {
+				c.kill()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// ack drops the frames up to seq from the replay buffer. It must be called
+// with the lock held.
+func (s *Session) ack(seq uint64) {
+	s.replay = s.replay[seq-s.acked:]
+	s.acked = seq
+	s.space.Broadcast()
+}
+
+// disconnected handles the loss of c.
+func (s *Session) disconnected(c *conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != c || s.err != nil {
+		return
+	}
+	s.conn = nil
+
+	var t *time.Timer
+	t = time.AfterFunc(s.cfg.ResumeTimeout, func() {
+		s.lock.Lock()
+		expired := s.expiry == t
+		s.lock.Unlock()
+		if expired {
+			s.fail(ErrSessionExpired)
+		}
+	})
+	s.expiry = t
+}
+
+func (s *Session) fail(err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.err = err
+	c := s.conn
+	s.conn = nil
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.replay = nil
+	s.space.Broadcast()
+	if err != io.EOF {
+		// Messages sent before the peer closed the session can still be
+		// read; otherwise they are dropped.
+		for _, msg := range s.queue {
+			s.pool.Put(msg)
+		}
+		s.queue = nil
+	}
+	s.received.Broadcast()
+	s.lock.Unlock()
+
+	close(s.closed)
+	if c != nil {
+		c.kill()
+	}
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+// Close tells the peer the session is over, closes the current connection
+// and ends the session. Messages not acknowledged yet may be lost.
+func (s *Session) Close() error {
+	s.lock.Lock()
+	c := s.conn
+	s.lock.Unlock()
+	if c != nil {
+		c.write([]byte{frameClose})
+	}
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) Write(msg []byte) (int, error) {
+	err := s.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// WriteMsg sends msg, or buffers it until the session is resumed if it is
+// disconnected. It blocks while the replay buffer is full.
+func (s *Session) WriteMsg(msg []byte) error {
+	frame := make([]byte, 1+varint.MaxLenUvarint63+len(msg))
+	frame[0] = frameData
+
+	for {
+		s.lock.Lock()
+		for s.err == nil && len(s.replay) >= s.cfg.ReplayBuffer {
+			s.space.Wait()
+		}
+		s.lock.Unlock()
+
+		// Wait for room without holding wlock, so that acks keep flowing,
+		// then check again as another writer may have taken it.
+		s.wlock.Lock()
+		s.lock.Lock()
+		if s.err != nil {
+			err := s.err
+			s.lock.Unlock()
+			s.wlock.Unlock()
+			if err == io.EOF {
+				err = ErrSessionClosed
+			}
+			return err
+		}
+		if len(s.replay) < s.cfg.ReplayBuffer {
+			break
+		}
+		s.lock.Unlock()
+		s.wlock.Unlock()
+	}
+	defer s.wlock.Unlock()
+
+	s.sent++
+	n := 1 + varint.PutUvarint(frame[1:], s.sent)
+	n += copy(frame[n:], msg)
+	frame = frame[:n]
+	s.replay = append(s.replay, frame)
+	c := s.conn
+	s.lock.Unlock()
+
+	if c != nil && c.write(frame) != nil {
+		c.kill()
+	}
+	return nil
+}
+
+func (s *Session) nextMsg() ([]byte, error) {
+	if s.next != nil {
+		return s.next, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.queue) == 0 && s.err == nil {
+		s.received.Wait()
+	}
+	if len(s.queue) == 0 {
+		if s.err == ErrSessionClosed {
+			return nil, io.EOF
+		}
+		return nil, s.err
+	}
+
+	msg := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.consumed++
+	if s.conn != nil {
+		s.conn.maybeAck(s.ackable(), s.cfg.AckEvery)
+	}
+	s.next = msg
+	return msg, nil
+}
+
+// ReadMsg returns the next message. It blocks while the session is
+// disconnected, and returns io.EOF once the session is closed.
+func (s *Session) ReadMsg() ([]byte, error) {
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+
+	msg, err := s.nextMsg()
+	if err != nil {
+		return nil, err
+	}
+	s.next = nil
+	return msg, nil
+}
+
+func (s *Session) Read(buf []byte) (int, error) {
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+
+	msg, err := s.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	s.next = nil
+	n := copy(buf, msg)
+	s.pool.Put(msg)
+	return n, nil
+}
+
+func (s *Session) NextMsgLen() (int, error) {
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+
+	msg, err := s.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *Session) ReleaseMsg(msg []byte) {
+	s.pool.Put(msg)
+}
+
+func (s *Session) readLoop(c *conn) {
+	defer close(c.done)
+	for {
+		msg, err := c.rw.ReadMsg()
+		if err != nil {
+			c.kill()
+			s.disconnected(c)
+			return
+		}
+		err = s.handleFrame(c, msg)
+		c.rw.ReleaseMsg(msg)
+		if err != nil {
+			c.kill()
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(c *conn, msg []byte) error {
+	if len(msg) == 0 {
+		return ErrProtocol
+	}
+	switch msg[0] {
+	case frameData:
+		seq, n, err := varint.FromUvarint(msg[1:])
+		if err != nil {
+			return ErrProtocol
+		}
+		payload := msg[1+n:]
+		buf := s.pool.Get(len(payload))
+		if buf == nil {
+			buf = []byte{}
+		}
+		copy(buf, payload)
+
+		// Queue the message rather than wait for the application, so that
+		// acks keep being processed.
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if seq != s.recvd+1 {
+			s.pool.Put(buf)
+			return ErrProtocol
+		}
+		s.recvd = seq
+		if s.err != nil {
+			s.pool.Put(buf)
+			return nil
+		}
+		s.queue = append(s.queue, buf)
+		s.received.Broadcast()
+		c.maybeAck(s.ackable(), s.cfg.AckEvery)
+	case frameAck:
+		seq, _, err := varint.FromUvarint(msg[1:])
+		if err != nil {
+			return ErrProtocol
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if seq > s.sent {
+			return ErrProtocol
+		}
+		if s.err == nil && seq > s.acked {
+			s.ack(seq)
+		}
+	case frameClose:
+		s.fail(io.EOF)
+	default:
+		return ErrProtocol
+	}
+	return nil
+}
+
+// ackLoop acknowledges received messages every AckInterval, or sooner when
+// the read loop asks.
+func (s *Session) ackLoop(c *conn) {
+	t := time.NewTicker(s.cfg.AckInterval)
+	defer t.Stop()
+	var buf [1 + varint.MaxLenUvarint63]byte
+	buf[0] = frameAck
+	for {
+		select {
+		case <-t.C:
+		case <-c.ackNow:
+		case <-c.dead:
+			return
+		}
+		s.lock.Lock()
+		seq := s.ackable()
+		s.lock.Unlock()
+		if seq <= c.lastAck.Load() {
+			continue
+		}
+		n := 1 + varint.PutUvarint(buf[1:], seq)
+		if err := c.write(buf[:n]); err != nil {
+			c.kill()
+			return
+		}
+		c.lastAck.Store(seq)
+	}
+}
+
+// ackable returns the last sequence number to acknowledge: everything
+// received, as long as the application keeps up. It must be called with
+// the lock held.
+func (s *Session) ackable() uint64 {
+	return min(s.recvd, s.consumed+uint64(s.cfg.ReceiveBuffer))
+}
+
+// maybeAck asks the ack loop to acknowledge up to seq now, if enough
+// messages wait for it.
+func (c *conn) maybeAck(seq uint64, every int) {
+	if seq >= c.lastAck.Load()+uint64(every) {
+		select {
+		case c.ackNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *conn) write(frame []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.rw.WriteMsg(frame)
+}
+
+// kill closes the connection, which makes its read loop return.
+func (c *conn) kill() {
+	c.once.Do(func() {
+		close(c.dead)
+		c.rw.Close()
+	})
+}
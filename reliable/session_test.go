@@ -0,0 +1,277 @@
+package reliable
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+var testConfig = &Config{AckInterval: 5 * time.Millisecond, ResumeTimeout: time.Second}
+
+// lossyConn drops everything written once lose is set, like a connection
+// that dies with data in flight.
+type lossyConn struct {
+	msgio.ReadWriteCloser
+	lose atomic.Bool
+}
+
+func (c *lossyConn) WriteMsg(msg []byte) error {
+	if c.lose.Load() {
+		return nil
+	}
+	return c.ReadWriteCloser.WriteMsg(msg)
+}
+
+// connect connects a client, new if s is nil, to srv.
+func connect(t *testing.T, srv *Server, s *Session) (*Session, *lossyConn, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	ca := &lossyConn{ReadWriteCloser: msgio.NewReadWriter(a)}
+
+	type accepted struct {
+		s   *Session
+		err error
+	}
+	done := make(chan accepted, 1)
+	go func() {
+		s, _, err := srv.Accept(msgio.NewReadWriter(b))
+		done <- accepted{s, err}
+	}()
+
+	var err error
+	if s == nil {
+		s, err = Client(ca, testConfig)
+	} else {
+		err = s.Resume(ca)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	return s, ca, res.s
+}
+
+func writeMsgs(t *testing.T, w msgio.Writer, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := w.WriteMsg([]byte(fmt.Sprint(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func expectMsgs(t *testing.T, r msgio.Reader, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != fmt.Sprint(i) {
+			t.Fatalf("expected %d, got %q", i, msg)
+		}
+		r.ReleaseMsg(msg)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionAck(t *testing.T) {
+	srv := NewServer(testConfig)
+	client, _, server := connect(t, srv, nil)
+	defer client.Close()
+	if client.Token() != server.Token() {
+		t.Fatal("tokens differ")
+	}
+
+	go writeMsgs(t, client, 0, 100)
+	expectMsgs(t, server, 0, 100)
+	waitFor(t, "acks", func() bool { return client.Unacked() == 0 })
+}
+
+func TestSessionResume(t *testing.T) {
+	srv := NewServer(testConfig)
+	client, conn, server := connect(t, srv, nil)
+	defer client.Close()
+
+	go writeMsgs(t, client, 0, 10)
+	expectMsgs(t, server, 0, 10)
+
+	// Messages the client writes from now on are lost with the
+	// connection.
+	conn.lose.Store(true)
+	writeMsgs(t, client, 10, 20)
+	go writeMsgs(t, server, 0, 5)
+	expectMsgs(t, client, 0, 5)
+	conn.Close()
+	<-client.Disconnected()
+
+	// Messages written while disconnected are buffered.
+	writeMsgs(t, client, 20, 30)
+
+	resumed, _, again := connect(t, srv, client)
+	if resumed != client || again != server {
+		t.Fatal("expected the same sessions")
+	}
+	go writeMsgs(t, server, 5, 10)
+	expectMsgs(t, server, 10, 30)
+	expectMsgs(t, client, 5, 10)
+	waitFor(t, "acks", func() bool { return client.Unacked() == 0 && server.Unacked() == 0 })
+}
+
+func TestSessionReplayBufferFull(t *testing.T) {
+	cfg := *testConfig
+	cfg.ReplayBuffer = 2
+	srv := NewServer(&cfg)
+	a, b := net.Pipe()
+	go srv.Accept(msgio.NewReadWriter(b))
+	client, err := Client(msgio.NewReadWriter(a), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	a.Close()
+	<-client.Disconnected()
+
+	writeMsgs(t, client, 0, 2)
+	written := make(chan struct{})
+	go func() {
+		writeMsgs(t, client, 2, 3)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write didn't block on a full replay buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, _, server := connect(t, srv, client)
+	expectMsgs(t, server, 0, 3)
+	<-written
+}
+
+func TestSessionUnknown(t *testing.T) {
+	srv := NewServer(testConfig)
+	client, conn, _ := connect(t, srv, nil)
+	defer client.Close()
+
+	// The server forgot the session.
+	srv.remove(client.Token())
+	conn.Close()
+
+	a, b := net.Pipe()
+	go srv.Accept(msgio.NewReadWriter(b))
+	if err := client.Resume(msgio.NewReadWriter(a)); err != ErrUnknownSession {
+		t.Fatalf("expected ErrUnknownSession, got %v", err)
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	cfg := *testConfig
+	cfg.ResumeTimeout = 10 * time.Millisecond
+	srv := NewServer(&cfg)
+	a, b := net.Pipe()
+	go srv.Accept(msgio.NewReadWriter(b))
+	client, err := Client(msgio.NewReadWriter(a), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	<-client.Done()
+	if err := client.Err(); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+	if err := client.WriteMsg([]byte("late")); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+	waitFor(t, "the server to drop the session", func() bool { return srv.Len() == 0 })
+}
+
+func TestSessionClose(t *testing.T) {
+	srv := NewServer(testConfig)
+	client, _, server := connect(t, srv, nil)
+
+	go func() {
+		writeMsgs(t, client, 0, 3)
+		client.Close()
+	}()
+	expectMsgs(t, server, 0, 3)
+	if _, err := server.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if err := server.WriteMsg([]byte("late")); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+	if _, err := client.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	waitFor(t, "the server to drop the session", func() bool { return srv.Len() == 0 })
+}
+
+func TestSessionBothWrite(t *testing.T) {
+	cfg := *testConfig
+	cfg.ReplayBuffer = 4
+	cfg.ReceiveBuffer = 2
+	srv := NewServer(&cfg)
+	a, b := net.Pipe()
+	accepted := make(chan *Session, 1)
+	go func() {
+		s, _, err := srv.Accept(msgio.NewReadWriter(b))
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- s
+	}()
+	client, err := Client(msgio.NewReadWriter(a), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+
+	// Neither side reads until it has written more than its replay buffer
+	// holds, which needs acks from the other.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeMsgs(t, server, 0, 6)
+		expectMsgs(t, server, 0, 6)
+	}()
+	writeMsgs(t, client, 0, 6)
+	expectMsgs(t, client, 0, 6)
+	<-done
+
+	// Without reads, the server acks its receive buffer and no more.
+	writeMsgs(t, client, 6, 12)
+	written := make(chan struct{})
+	go func() {
+		writeMsgs(t, client, 12, 13)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write didn't block on a full receive buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	expectMsgs(t, server, 6, 13)
+	<-written
+}
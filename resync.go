@@ -0,0 +1,275 @@
+package msgio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// Resync framing puts a header in front of every message:
+//
+//	marker (4 bytes) | length (uint32) | CRC-32C of marker and length (4 bytes)
+//
+// A reader that finds a header with a bad marker or checksum scans forward
+// for the next valid one, so a corrupted length prefix costs the frames it
+// damages rather than the rest of the stream. Only the header is
+// checksummed: protecting the payload is left to the application.
+var resyncMarker = [4]byte{0xf1, 0x6d, 0x73, 0x67}
+
+const resyncHeaderSize = len(resyncMarker) + lengthSize + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ResyncFraming is the framing written by NewResyncWriter.
+var ResyncFraming Framing = resyncFraming{}
+
+type resyncFraming struct{}
+
+func (resyncFraming) Name() string { return "resync" }
+
+func (resyncFraming) NewReader(r io.Reader, maxSize int) ReadCloser {
+	return NewResyncReaderSize(r, maxSize)
+}
+
+func (resyncFraming) NewWriter(w io.Writer) WriteCloser {
+	return NewResyncWriter(w)
+}
+
+// frameSize skips to the next valid header, counting the skipped bytes as
+// part of the prefix. It is needed because ResyncReader buffers, so the
+// bytes it consumes don't tell where a frame ends.
+func (resyncFraming) frameSize(r io.Reader) (int, int, error) {
+	var hdr [resyncHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	skipped := 0
+	for !validResyncHeader(hdr[:]) {
+		copy(hdr[:], hdr[1:])
+		if _, err := io.ReadFull(r, hdr[resyncHeaderSize-1:]); err != nil {
+			return 0, 0, err
+		}
+		skipped++
+	}
+	return skipped + resyncHeaderSize, int(NBO.Uint32(hdr[len(resyncMarker):])), nil
+}
+
+// resyncWriter is the underlying type that implements the Writer interface.
+type resyncWriter struct {
+	W io.Writer
+
+	pool *pool.BufferPool
+	lock sync.Mutex
+}
+
+// NewResyncWriter wraps an io.Writer with a msgio framed writer that
+// prefixes every message with a sync marker and a checksummed header, see
+// NewResyncReader.
+func NewResyncWriter(w io.Writer) WriteCloser {
+	return NewResyncWriterWithPool(w, pool.GlobalPool)
+}
+
+// NewResyncWriterWithPool is the same as NewResyncWriter but allows one to
+// specify a buffer pool.
+func NewResyncWriterWithPool(w io.Writer, p *pool.BufferPool) WriteCloser {
+	if p == nil {
+		panic("nil pool")
+	}
+	return &resyncWriter{W: w, pool: p}
+}
+
+func (s *resyncWriter) Write(msg []byte) (int, error) {
+	err := s.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (s *resyncWriter) WriteMsg(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf := s.pool.Get(resyncHeaderSize + len(msg))
+	putResyncHeader(buf, len(msg))
+	copy(buf[resyncHeaderSize:], msg)
+	_, err := s.W.Write(buf)
+	s.pool.Put(buf)
+
+	return err
+}
+
+func (s *resyncWriter) Close() error {
+	if c, ok := s.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func putResyncHeader(buf []byte, length int) {
+	copy(buf, resyncMarker[:])
+	NBO.PutUint32(buf[len(resyncMarker):], uint32(length))
+	sum := crc32.Checksum(buf[:len(resyncMarker)+lengthSize], castagnoli)
+	binary.BigEndian.PutUint32(buf[len(resyncMarker)+lengthSize:], sum)
+}
+
+func validResyncHeader(hdr []byte) bool {
+	if !bytes.Equal(hdr[:len(resyncMarker)], resyncMarker[:]) {
+		return false
+	}
+	sum := crc32.Checksum(hdr[:len(resyncMarker)+lengthSize], castagnoli)
+	return sum == binary.BigEndian.Uint32(hdr[len(resyncMarker)+lengthSize:])
+}
+
+// ResyncReader reads messages written by a resync writer. When it meets a
+// corrupt header it skips forward to the next valid one instead of failing,
+// and counts the bytes it skipped.
+type ResyncReader struct {
+	R  io.Reader
+	br *bufio.Reader
+
+	next    int
+	skipped atomic.Int64
+	pool    *pool.BufferPool
+	lock    sync.Mutex
+	max     int // the maximal message size (in bytes) this reader handles
+}
+
+// NewResyncReader wraps an io.Reader with a msgio framed reader that
+// recovers from corruption, see ResyncReader.
+func NewResyncReader(r io.Reader) *ResyncReader {
+	return NewResyncReaderSize(r, defaultMaxSize)
+}
+
+// NewResyncReaderSize is equivalent to NewResyncReader but allows one to
+// specify a max message size.
+func NewResyncReaderSize(r io.Reader, maxMessageSize int) *ResyncReader {
+	return NewResyncReaderSizeWithPool(r, maxMessageSize, pool.GlobalPool)
+}
+
+// NewResyncReaderSizeWithPool is the same as NewResyncReader but allows one
+// to specify a buffer pool and a max message size.
+func NewResyncReaderSizeWithPool(r io.Reader, maxMessageSize int, p *pool.BufferPool) *ResyncReader {
+	if p == nil {
+		panic("nil pool")
+	}
+	return &ResyncReader{
+		R:    r,
+		br:   bufio.NewReader(r),
+		next: -1,
+		pool: p,
+		max:  maxMessageSize,
+	}
+}
+
+// Skipped returns the number of bytes skipped so far while looking for a
+// valid header.
+func (s *ResyncReader) Skipped() int64 {
+	return s.skipped.Load()
+}
+
+// NextMsgLen finds the next valid header and returns the length it holds.
+// Like the other readers, it consumes the header.
+func (s *ResyncReader) NextMsgLen() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nextMsgLen()
+}
+
+func (s *ResyncReader) nextMsgLen() (int, error) {
+	for s.next == -1 {
+		hdr, err := s.br.Peek(resyncHeaderSize)
+		if len(hdr) < resyncHeaderSize {
+			// Nothing is consumed, so a reader tailing a growing file can
+			// try again later.
+			if err == io.EOF && len(hdr) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if validResyncHeader(hdr) {
+			s.next = int(NBO.Uint32(hdr[len(resyncMarker):]))
+			s.br.Discard(resyncHeaderSize)
+			break
+		}
+
+		// skip up to the next byte that could start a marker
+		skip := bytes.IndexByte(hdr[1:], resyncMarker[0]) + 1
+		if skip == 0 {
+			skip = len(hdr)
+		}
+		s.br.Discard(skip)
+		s.skipped.Add(int64(skip))
+	}
+	return s.next, nil
+}
+
+func (s *ResyncReader) Read(msg []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	length, err := s.nextMsgLen()
+	if err != nil {
+		return 0, err
+	}
+
+	if length > len(msg) {
+		return 0, io.ErrShortBuffer
+	}
+
+	read, err := io.ReadFull(s.br, msg[:length])
+	if read < length {
+		s.next = length - read // we only partially consumed the message.
+	} else {
+		s.next = -1 // signal we've consumed this msg
+	}
+	return read, err
+}
+
+// ReadMsg reads the next message. A message larger than the max size is
+// reported with ErrMsgTooLarge and its payload is skipped by the next read.
+func (s *ResyncReader) ReadMsg() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	length, err := s.nextMsgLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		s.next = -1
+		return nil, nil
+	}
+
+	if length > s.max {
+		s.next = -1
+		return nil, ErrMsgTooLarge
+	}
+
+	msg := s.pool.Get(length)
+	read, err := io.ReadFull(s.br, msg)
+	if read < length {
+		s.next = length - read // we only partially consumed the message.
+	} else {
+		s.next = -1 // signal we've consumed this msg
+	}
+	return msg[:read], err
+}
+
+func (s *ResyncReader) ReleaseMsg(msg []byte) {
+	s.pool.Put(msg)
+}
+
+func (s *ResyncReader) Close() error {
+	if c, ok := s.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func writeResync(t *testing.T, msgs ...string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := NewResyncWriter(buf)
+	for _, m := range msgs {
+		if err := w.WriteMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func expectMsgs(t *testing.T, r Reader, msgs ...string) {
+	t.Helper()
+	for _, m := range msgs {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Fatalf("expected %q, got %q", m, msg)
+		}
+		r.ReleaseMsg(msg)
+	}
+}
+
+func TestResyncRoundTrip(t *testing.T) {
+	r := NewResyncReader(bytes.NewReader(writeResync(t, "hello", "", "world")))
+	expectMsgs(t, r, "hello", "", "world")
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if r.Skipped() != 0 {
+		t.Fatalf("expected nothing skipped, got %d", r.Skipped())
+	}
+}
+
+func TestResyncCorruptLength(t *testing.T) {
+	data := writeResync(t, "first", "second", "third")
+	// flip a bit in the length of the second frame
+	second := resyncHeaderSize + len("first")
+	data[second+len(resyncMarker)+3] ^= 0x40
+
+	r := NewResyncReader(bytes.NewReader(data))
+	expectMsgs(t, r, "first", "third")
+	if expected := int64(resyncHeaderSize + len("second")); r.Skipped() != expected {
+		t.Fatalf("expected %d bytes skipped, got %d", expected, r.Skipped())
+	}
+}
+
+func TestResyncGarbage(t *testing.T) {
+	garbage := append([]byte("noise"), resyncMarker[:]...)
+	garbage = append(garbage, "more noise"...)
+	var data []byte
+	data = append(data, garbage...)
+	data = append(data, writeResync(t, "a")...)
+	data = append(data, garbage...)
+	data = append(data, writeResync(t, "b")...)
+
+	r := NewResyncReader(bytes.NewReader(data))
+	expectMsgs(t, r, "a", "b")
+	if r.Skipped() != int64(2*len(garbage)) {
+		t.Fatalf("expected %d bytes skipped, got %d", 2*len(garbage), r.Skipped())
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestResyncTooLarge(t *testing.T) {
+	r := NewResyncReaderSize(bytes.NewReader(writeResync(t, "this is too large", "ok")), 4)
+	if _, err := r.ReadMsg(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	expectMsgs(t, r, "ok")
+}
+
+func TestResyncPartialHeader(t *testing.T) {
+	data := writeResync(t, "tail")
+	src := bytes.NewBuffer(append([]byte(nil), data[:5]...))
+	r := NewResyncReader(src)
+	if _, err := r.ReadMsg(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+
+	// the rest shows up later
+	src.Write(data[5:])
+	expectMsgs(t, r, "tail")
+	if r.Skipped() != 0 {
+		t.Fatalf("expected nothing skipped, got %d", r.Skipped())
+	}
+}
+
+func TestResyncShortBuffer(t *testing.T) {
+	r := NewResyncReader(bytes.NewReader(writeResync(t, "hello")))
+	if _, err := r.Read(make([]byte, 2)); err != io.ErrShortBuffer {
+		t.Fatalf("expected ErrShortBuffer, got %v", err)
+	}
+	buf := make([]byte, 10)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q", buf[:n])
+	}
+}
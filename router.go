@@ -0,0 +1,223 @@
+package msgio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/multiformats/go-varint"
+)
+
+// ErrUnknownType is returned by Router.Serve for a message whose type has
+// no handler, with the UnknownFail policy.
+var ErrUnknownType = errors.New("unknown message type")
+
+// TagDecoder extracts the type tag of a message, and returns the payload
+// to hand to its handler.
+type TagDecoder func(msg []byte) (tag uint64, payload []byte, err error)
+
+// UvarintTag decodes a uvarint type tag prefixed to the payload.
+func UvarintTag(msg []byte) (uint64, []byte, error) {
+	tag, n, err := varint.FromUvarint(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return tag, msg[n:], nil
+}
+
+// ProtobufFieldTag uses the field number of the first field of a protobuf
+// message as its type tag, as with a wrapper message holding a oneof. The
+// payload is the whole message.
+func ProtobufFieldTag(msg []byte) (uint64, []byte, error) {
+	key, _, err := varint.FromUvarint(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	if key>>3 == 0 {
+		return 0, nil, errors.New("invalid protobuf field number")
+	}
+	return key >> 3, msg, nil
+}
+
+// Handler handles a message of the given type. The message is only valid
+// until the handler returns. The context is canceled when the router stops.
+type Handler func(ctx context.Context, tag uint64, msg []byte) error
+
+// UnknownPolicy decides what a Router does with messages of a type that has
+// no handler.
+type UnknownPolicy int
+
+const (
+	// UnknownDrop drops them.
+	UnknownDrop UnknownPolicy = iota
+	// UnknownFail stops the router with ErrUnknownType.
+	UnknownFail
+)
+
+// Router reads messages from a Reader and dispatches them to handlers by
+// type tag.
+//
+// By default messages are handled concurrently, each in its own goroutine,
+// bounded by the concurrency limit of its handler. When a handler is at its
+// limit, the router stops reading until it frees up, which pushes back on
+// the sender. With Ordered set, messages are handled one at a time, in the
+// order they are read.
+type Router struct {
+	src Reader
+	tag TagDecoder
+
+	// Ordered makes the router handle every message before reading the
+	// next one. It must be set before calling Serve.
+	Ordered bool
+
+	// Unknown is the policy for messages of types without a handler, when
+	// there is no fallback handler. It must be set before calling Serve.
+	Unknown UnknownPolicy
+
+	lock     sync.RWMutex
+	routes   map[uint64]*route
+	fallback *route
+}
+
+type route struct {
+	h   Handler
+	sem chan struct{} // nil if unlimited
+}
+
+// NewRouter returns a Router reading from r, decoding type tags with tag.
+func NewRouter(r Reader, tag TagDecoder) *Router {
+	return &Router{src: r, tag: tag, routes: make(map[uint64]*route)}
+}
+
+func newRoute(h Handler, limit int) *route {
+	rt := &route{h: h}
+	if limit > 0 {
+		rt.sem = make(chan struct{}, limit)
+	}
+	return rt
+}
+
+// Handle registers h for messages of type tag, running at most limit
+// messages at once. A limit of zero means no limit.
+func (r *Router) Handle(tag uint64, h Handler, limit int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes[tag] = newRoute(h, limit)
+}
+
+// HandleUnknown registers h for messages of every type without a handler,
+// running at most limit messages at once. It overrides the Unknown policy.
+func (r *Router) HandleUnknown(h Handler, limit int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.fallback = newRoute(h, limit)
+}
+
+func (r *Router) route(tag uint64) *route {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if rt, ok := r.routes[tag]; ok {
+		return rt
+	}
+	return r.fallback
+}
+
+// Serve reads and dispatches messages until the reader returns an error, a
+// handler fails or ctx is canceled, and waits for running handlers before
+// returning. It returns nil once the reader reaches io.EOF, and the first
+// error otherwise.
+//
+// Serve can't interrupt a read: if a handler fails or ctx is canceled while
+// it waits for a message, it only returns after that read does. Close the
+// reader to stop it sooner.
+func (r *Router) Serve(ctx context.Context) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		err  error
+	)
+	fail := func(e error) {
+		once.Do(func() {
+			err = e
+			cancel()
+		})
+	}
+
+	for ctx.Err() == nil {
+		msg, rerr := r.src.ReadMsg()
+		if rerr != nil {
+			if rerr != io.EOF {
+				fail(rerr)
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			r.src.ReleaseMsg(msg)
+			break
+		}
+		if !r.dispatch(ctx, &wg, fail, msg) {
+			break
+		}
+	}
+
+	wg.Wait()
+	once.Do(func() { err = parent.Err() })
+	return err
+}
+
+// dispatch hands msg to its handler and reports whether to keep reading.
+func (r *Router) dispatch(ctx context.Context, wg *sync.WaitGroup, fail func(error), msg []byte) bool {
+	tag, payload, err := r.tag(msg)
+	if err != nil {
+		r.src.ReleaseMsg(msg)
+		fail(err)
+		return false
+	}
+
+	rt := r.route(tag)
+	if rt == nil {
+		r.src.ReleaseMsg(msg)
+		if r.Unknown == UnknownFail {
+			fail(ErrUnknownType)
+			return false
+		}
+		return true
+	}
+
+	if r.Ordered {
+		err := rt.h(ctx, tag, payload)
+		r.src.ReleaseMsg(msg)
+		if err != nil {
+			fail(err)
+			return false
+		}
+		return true
+	}
+
+	if rt.sem != nil {
+		select {
+		case rt.sem <- struct{}{}:
+		case <-ctx.Done():
+			r.src.ReleaseMsg(msg)
+			return false
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := rt.h(ctx, tag, payload)
+		r.src.ReleaseMsg(msg)
+		if rt.sem != nil {
+			<-rt.sem
+		}
+		if err != nil {
+			fail(err)
+		}
+	}()
+	return true
+}
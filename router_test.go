@@ -0,0 +1,152 @@
+package msgio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-varint"
+)
+
+func taggedMsgs(t *testing.T, msgs ...any) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := NewVarintWriter(buf)
+	for i := 0; i < len(msgs); i += 2 {
+		msg := append(varint.ToUvarint(uint64(msgs[i].(int))), msgs[i+1].(string)...)
+		if err := w.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf
+}
+
+func TestRouterOrdered(t *testing.T) {
+	r := NewRouter(NewVarintReader(taggedMsgs(t, 1, "a", 2, "b", 1, "c", 3, "dropped", 2, "d")), UvarintTag)
+	r.Ordered = true
+	var got []string
+	h := func(ctx context.Context, tag uint64, msg []byte) error {
+		got = append(got, string(rune('0'+tag))+string(msg))
+		return nil
+	}
+	r.Handle(1, h, 0)
+	r.Handle(2, h, 0)
+	if err := r.Serve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"1a", "2b", "1c", "2d"}; len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	} else {
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("expected %v, got %v", expected, got)
+			}
+		}
+	}
+}
+
+func TestRouterUnknown(t *testing.T) {
+	r := NewRouter(NewVarintReader(taggedMsgs(t, 1, "a", 7, "b")), UvarintTag)
+	r.Unknown = UnknownFail
+	r.Handle(1, func(context.Context, uint64, []byte) error { return nil }, 0)
+	if err := r.Serve(context.Background()); err != ErrUnknownType {
+		t.Fatalf("expected ErrUnknownType, got %v", err)
+	}
+
+	r = NewRouter(NewVarintReader(taggedMsgs(t, 1, "a", 7, "b")), UvarintTag)
+	r.Unknown = UnknownFail
+	var unknown []uint64
+	r.HandleUnknown(func(_ context.Context, tag uint64, _ []byte) error {
+		unknown = append(unknown, tag)
+		return nil
+	}, 1)
+	r.Handle(1, func(context.Context, uint64, []byte) error { return nil }, 0)
+	if err := r.Serve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 1 || unknown[0] != 7 {
+		t.Fatalf("expected type 7 to fall back, got %v", unknown)
+	}
+}
+
+func TestRouterConcurrencyLimit(t *testing.T) {
+	var msgs []any
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, 1, "x", 2, "y")
+	}
+	r := NewRouter(NewVarintReader(taggedMsgs(t, msgs...)), UvarintTag)
+
+	var running, peak, handled atomic.Int32
+	r.Handle(1, func(context.Context, uint64, []byte) error {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		handled.Add(1)
+		return nil
+	}, 3)
+	r.Handle(2, func(context.Context, uint64, []byte) error {
+		handled.Add(1)
+		return nil
+	}, 0)
+
+	if err := r.Serve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if handled.Load() != 40 {
+		t.Fatalf("expected 40 messages handled, got %d", handled.Load())
+	}
+	if peak.Load() > 3 {
+		t.Fatalf("expected at most 3 concurrent handlers, saw %d", peak.Load())
+	}
+}
+
+func TestRouterHandlerError(t *testing.T) {
+	boom := errors.New("boom")
+	r := NewRouter(NewVarintReader(taggedMsgs(t, 1, "a", 1, "fail", 1, "b")), UvarintTag)
+	var (
+		lock     sync.Mutex
+		canceled bool
+	)
+	r.Handle(1, func(ctx context.Context, _ uint64, msg []byte) error {
+		if string(msg) == "fail" {
+			return boom
+		}
+		if string(msg) == "a" {
+			<-ctx.Done()
+			lock.Lock()
+			canceled = true
+			lock.Unlock()
+		}
+		return nil
+	}, 0)
+	if err := r.Serve(context.Background()); err != boom {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	if !canceled {
+		t.Fatal("expected running handlers to be canceled")
+	}
+}
+
+func TestProtobufFieldTag(t *testing.T) {
+	// field 5, length delimited
+	tag, payload, err := ProtobufFieldTag([]byte{5<<3 | 2, 1, 'x'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != 5 || len(payload) != 3 {
+		t.Fatalf("expected tag 5 and the whole message, got %d and %x", tag, payload)
+	}
+	if _, _, err := ProtobufFieldTag([]byte{2}); err == nil {
+		t.Fatal("expected field number 0 to be rejected")
+	}
+}
@@ -0,0 +1,327 @@
+// Package rpc implements request/response calls over a msgio.ReadWriteCloser.
+//
+// Each frame starts with a type byte and a uvarint correlation ID. Requests
+// additionally carry a uvarint-prefixed method name, errors carry a code
+// byte, and the rest of the frame is the payload. Both ends of a Conn may
+// issue calls and serve handlers at the same time.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-varint"
+)
+
+var (
+	// ErrClosed is returned by Call once the Conn has been closed.
+	ErrClosed = errors.New("rpc: connection closed")
+
+	// ErrUnknownMethod is returned by Call when the peer has no handler
+	// registered for the method.
+	ErrUnknownMethod = errors.New("rpc: unknown method")
+
+	// ErrProtocol is returned when the peer sends a malformed frame.
+	ErrProtocol = errors.New("rpc: protocol error")
+)
+
+// RemoteError is returned by Call when the peer's handler fails.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "rpc: remote error: " + e.Message
+}
+
+const (
+	frameRequest byte = iota
+	frameResponse
+	frameError
+	frameCancel
+)
+
+const (
+	codeHandler byte = iota
+	codeUnknownMethod
+)
+
+// Handler serves a single request. The context is cancelled when the caller
+// gives up on the call or the Conn closes. Handlers may run concurrently.
+type Handler func(ctx context.Context, req []byte) ([]byte, error)
+
+type result struct {
+	resp []byte
+	err  error
+}
+
+// Conn is one end of an RPC connection.
+type Conn struct {
+	rw   msgio.ReadWriteCloser
+	pool *pool.BufferPool
+
+	wlock sync.Mutex
+
+	lock     sync.Mutex
+	nextID   uint64
+	pending  map[uint64]chan result
+	inflight map[uint64]context.CancelFunc
+	handlers map[string]Handler
+	err      error
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// NewConn starts serving RPCs over rw. The Conn owns rw from now on and
+// closes it on Close.
+func NewConn(rw msgio.ReadWriteCloser) *Conn {
+	c := &Conn{
+		rw:       rw,
+		pool:     pool.GlobalPool,
+		pending:  make(map[uint64]chan result),
+		inflight: make(map[uint64]context.CancelFunc),
+		handlers: make(map[string]Handler),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Handle registers h for method, replacing any previous handler. Passing a
+// nil handler unregisters the method.
+func (c *Conn) Handle(method string, h Handler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if h == nil {
+		delete(c.handlers, method)
+		return
+	}
+	c.handlers[method] = h
+}
+
+// Call invokes method on the peer and waits for the response. If ctx is
+// cancelled first, the peer is told to cancel the request and ctx.Err() is
+// returned.
+func (c *Conn) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	ch := make(chan result, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	if err := c.writeFrame(frameRequest, id, method, 0, req); err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		return res.resp, res.err
+	case <-ctx.Done():
+		if c.forget(id) {
+			c.writeFrame(frameCancel, id, "", 0, nil)
+		}
+		return nil, ctx.Err()
+	case <-c.closed:
+		c.forget(id)
+		return nil, c.Err()
+	}
+}
+
+// forget removes a pending call and reports whether it was still pending.
+func (c *Conn) forget(id uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.pending[id]
+	delete(c.pending, id)
+	return ok
+}
+
+// Err returns the error that terminated the Conn, if any.
+func (c *Conn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Close closes the Conn and the underlying ReadWriteCloser. Outstanding
+// calls fail with ErrClosed and running handlers have their contexts
+// cancelled.
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	err := c.rw.Close()
+	<-c.done
+	return err
+}
+
+func (c *Conn) fail(err error) {
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return
+	}
+	c.err = err
+	inflight := c.inflight
+	c.inflight = make(map[uint64]context.CancelFunc)
+	c.lock.Unlock()
+
+	close(c.closed)
+	for _, cancel := range inflight {
+		cancel()
+	}
+}
+
+func (c *Conn) writeFrame(typ byte, id uint64, method string, code byte, payload []byte) error {
+	size := 1 + varint.MaxLenUvarint63 + len(payload)
+	switch typ {
+	case frameRequest:
+		size += varint.MaxLenUvarint63 + len(method)
+	case frameError:
+		size++
+	}
+
+	buf := c.pool.Get(size)
+	buf[0] = typ
+	n := 1 + varint.PutUvarint(buf[1:], id)
+	switch typ {
+	case frameRequest:
+		n += varint.PutUvarint(buf[n:], uint64(len(method)))
+		n += copy(buf[n:], method)
+	case frameError:
+		buf[n] = code
+		n++
+	}
+	n += copy(buf[n:], payload)
+
+	c.wlock.Lock()
+	err := c.rw.WriteMsg(buf[:n])
+	c.wlock.Unlock()
+	c.pool.Put(buf)
+
+	if err != nil {
+		c.fail(err)
+	}
+	return err
+}
+
+func (c *Conn) readLoop() {
+	defer close(c.done)
+	for {
+		msg, err := c.rw.ReadMsg()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		err = c.handleFrame(msg)
+		c.rw.ReleaseMsg(msg)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Conn) handleFrame(msg []byte) error {
+	if len(msg) < 2 {
+		return ErrProtocol
+	}
+	typ := msg[0]
+	id, n, err := varint.FromUvarint(msg[1:])
+	if err != nil {
+		return ErrProtocol
+	}
+	rest := msg[1+n:]
+
+	switch typ {
+	case frameRequest:
+		l, n, err := varint.FromUvarint(rest)
+		if err != nil || l > uint64(len(rest)-n) {
+			return ErrProtocol
+		}
+		method := string(rest[n : n+int(l)])
+		req := append([]byte(nil), rest[n+int(l):]...)
+		c.serve(id, method, req)
+	case frameResponse:
+		c.deliver(id, result{resp: append([]byte(nil), rest...)})
+	case frameError:
+		if len(rest) < 1 {
+			return ErrProtocol
+		}
+		var err error
+		switch rest[0] {
+		case codeUnknownMethod:
+			err = ErrUnknownMethod
+		default:
+			err = &RemoteError{Message: string(rest[1:])}
+		}
+		c.deliver(id, result{err: err})
+	case frameCancel:
+		c.lock.Lock()
+		cancel := c.inflight[id]
+		delete(c.inflight, id)
+		c.lock.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	default:
+		return ErrProtocol
+	}
+	return nil
+}
+
+func (c *Conn) deliver(id uint64, res result) {
+	c.lock.Lock()
+	ch := c.pending[id]
+	delete(c.pending, id)
+	c.lock.Unlock()
+
+	// Responses to calls that were cancelled or forgotten are dropped.
+	if ch != nil {
+		ch <- res
+	}
+}
+
+func (c *Conn) serve(id uint64, method string, req []byte) {
+	c.lock.Lock()
+	h := c.handlers[method]
+	if h == nil || c.err != nil {
+		c.lock.Unlock()
+		go c.writeFrame(frameError, id, "", codeUnknownMethod, nil)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.inflight[id] = cancel
+	c.lock.Unlock()
+
+	go func() {
+		resp, err := h(ctx, req)
+
+		c.lock.Lock()
+		_, live := c.inflight[id]
+		delete(c.inflight, id)
+		c.lock.Unlock()
+		cancel()
+
+		// The caller no longer waits for a cancelled request.
+		if !live {
+			return
+		}
+		if err != nil {
+			c.writeFrame(frameError, id, "", codeHandler, []byte(err.Error()))
+			return
+		}
+		c.writeFrame(frameResponse, id, "", 0, resp)
+	}()
+}
@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+func newPair(t *testing.T) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	ca := NewConn(msgio.NewReadWriter(a))
+	cb := NewConn(msgio.NewReadWriter(b))
+	t.Cleanup(func() {
+		ca.Close()
+		cb.Close()
+	})
+	return ca, cb
+}
+
+func TestCall(t *testing.T) {
+	client, server := newPair(t)
+	server.Handle("echo", func(ctx context.Context, req []byte) ([]byte, error) {
+		return req, nil
+	})
+
+	resp, err := client.Call(context.Background(), "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "hello" {
+		t.Fatalf("expected hello, got %q", resp)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	client, server := newPair(t)
+	server.Handle("echo", func(ctx context.Context, req []byte) ([]byte, error) {
+		// finish out of order
+		time.Sleep(time.Duration(len(req)%5) * time.Millisecond)
+		return req, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := fmt.Sprintf("request %d", i)
+			resp, err := client.Call(context.Background(), "echo", []byte(req))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(resp) != req {
+				t.Errorf("expected %q, got %q", req, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestErrors(t *testing.T) {
+	client, server := newPair(t)
+	server.Handle("fail", func(ctx context.Context, req []byte) ([]byte, error) {
+		return nil, errors.New("boom")
+	})
+
+	_, err := client.Call(context.Background(), "fail", nil)
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Message != "boom" {
+		t.Fatalf("expected remote error boom, got %v", err)
+	}
+
+	if _, err := client.Call(context.Background(), "missing", nil); err != ErrUnknownMethod {
+		t.Fatalf("expected ErrUnknownMethod, got %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	client, server := newPair(t)
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	server.Handle("block", func(ctx context.Context, req []byte) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := client.Call(ctx, "block", nil); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
+
+func TestBidirectional(t *testing.T) {
+	a, b := newPair(t)
+	a.Handle("name", func(context.Context, []byte) ([]byte, error) { return []byte("a"), nil })
+	b.Handle("name", func(context.Context, []byte) ([]byte, error) { return []byte("b"), nil })
+
+	if resp, err := a.Call(context.Background(), "name", nil); err != nil || string(resp) != "b" {
+		t.Fatalf("expected b, got %q (%v)", resp, err)
+	}
+	if resp, err := b.Call(context.Background(), "name", nil); err != nil || string(resp) != "a" {
+		t.Fatalf("expected a, got %q (%v)", resp, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, server := newPair(t)
+
+	started := make(chan struct{})
+	server.Handle("block", func(ctx context.Context, req []byte) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	errs := make(chan error)
+	go func() {
+		_, err := client.Call(context.Background(), "block", nil)
+		errs <- err
+	}()
+	<-started
+	client.Close()
+
+	if err := <-errs; err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := client.Call(context.Background(), "block", nil); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Package secure provides an authenticated, encrypted msgio.ReadWriter
+// established over an existing msgio.ReadWriter.
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	msgio "github.com/libp2p/go-msgio"
+)
+
+// ErrNonceExhausted is returned once a direction has sent 2^64-1 messages
+// and can no longer be used safely.
+var ErrNonceExhausted = errors.New("secure: nonce space exhausted")
+
+// ErrDecrypt is returned when a received frame fails authentication.
+var ErrDecrypt = errors.New("secure: message authentication failed")
+
+// Conn is a msgio.ReadWriteCloser whose frames are sealed with AES-256-GCM.
+// Every frame of the underlying ReadWriter carries exactly one sealed message.
+type Conn struct {
+	rw msgio.ReadWriter
+
+	rlock sync.Mutex
+	rseq  uint64
+	raead cipher.AEAD
+	next  []byte // a message not consumed by a short Read yet
+
+	wlock sync.Mutex
+	wseq  uint64
+	waead cipher.AEAD
+
+	remote ed25519.PublicKey
+	pool   *pool.BufferPool
+}
+
+func newConn(rw msgio.ReadWriter, readKey, writeKey []byte) (*Conn, error) {
+	raead, err := newAEAD(readKey)
+	if err != nil {
+		return nil, err
+	}
+	waead, err := newAEAD(writeKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		rw:    rw,
+		raead: raead,
+		waead: waead,
+		pool:  pool.GlobalPool,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RemotePublicKey returns the static key the peer authenticated with during
+// the handshake, or nil if the peer did not present one.
+func (c *Conn) RemotePublicKey() ed25519.PublicKey {
+	return c.remote
+}
+
+func nonce(buf []byte, seq uint64) []byte {
+	clear(buf)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], seq)
+	return buf
+}
+
+func (c *Conn) Write(msg []byte) (int, error) {
+	err := c.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (c *Conn) WriteMsg(msg []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.wseq == ^uint64(0) {
+		return ErrNonceExhausted
+	}
+
+	var nbuf [12]byte
+	buf := c.pool.Get(len(msg) + c.waead.Overhead())
+	sealed := c.waead.Seal(buf[:0], nonce(nbuf[:c.waead.NonceSize()], c.wseq), msg, nil)
+	c.wseq++
+	err := c.rw.WriteMsg(sealed)
+	c.pool.Put(buf)
+	return err
+}
+
+// NextMsgLen returns the plaintext length of the next message.
+func (c *Conn) NextMsgLen() (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	if c.next != nil {
+		return len(c.next), nil
+	}
+	n, err := c.rw.NextMsgLen()
+	if err != nil {
+		return 0, err
+	}
+	if n < c.raead.Overhead() {
+		return 0, ErrDecrypt
+	}
+	return n - c.raead.Overhead(), nil
+}
+
+func (c *Conn) Read(msg []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	buf, err := c.nextMsg()
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) > len(msg) {
+		return 0, io.ErrShortBuffer
+	}
+	c.next = nil
+	n := copy(msg, buf)
+	c.pool.Put(buf)
+	return n, nil
+}
+
+func (c *Conn) ReadMsg() ([]byte, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	msg, err := c.nextMsg()
+	if err != nil {
+		return nil, err
+	}
+	c.next = nil
+	return msg, nil
+}
+
+// nextMsg reads and decrypts the next message unless one is pending.
+func (c *Conn) nextMsg() ([]byte, error) {
+	if c.next != nil {
+		return c.next, nil
+	}
+
+	sealed, err := c.rw.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	defer c.rw.ReleaseMsg(sealed)
+
+	if c.rseq == ^uint64(0) {
+		return nil, ErrNonceExhausted
+	}
+	if len(sealed) < c.raead.Overhead() {
+		return nil, ErrDecrypt
+	}
+
+	var nbuf [12]byte
+	buf := c.pool.Get(len(sealed) - c.raead.Overhead())
+	msg, err := c.raead.Open(buf[:0], nonce(nbuf[:c.raead.NonceSize()], c.rseq), sealed, nil)
+	if err != nil {
+		c.pool.Put(buf)
+		return nil, ErrDecrypt
+	}
+	c.rseq++
+	if msg == nil {
+		msg = []byte{}
+	}
+	c.next = msg
+	return msg, nil
+}
+
+func (c *Conn) ReleaseMsg(msg []byte) {
+	c.pool.Put(msg)
+}
+
+func (c *Conn) Close() error {
+	if cl, ok := c.rw.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package secure
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+// ErrBadHandshake is returned when the peer sends a malformed handshake frame.
+var ErrBadHandshake = errors.New("secure: malformed handshake message")
+
+// ErrBadSignature is returned when the peer's static key signature does not
+// cover this handshake.
+var ErrBadSignature = errors.New("secure: invalid handshake signature")
+
+// ErrPeerUnauthenticated is returned when VerifyPeer is set but the peer did
+// not present a static key.
+var ErrPeerUnauthenticated = errors.New("secure: peer did not authenticate")
+
+const protocolID = "/msgio/secure/1.0.0"
+
+// Config configures one side of a handshake. The zero value performs an
+// anonymous (unauthenticated) key exchange.
+type Config struct {
+	// PrivateKey, if set, is used to sign the handshake so the peer can
+	// authenticate us.
+	PrivateKey ed25519.PrivateKey
+
+	// VerifyPeer, if set, requires the peer to present a static key and is
+	// called with it after its signature has been checked. Returning an
+	// error aborts the handshake.
+	VerifyPeer func(ed25519.PublicKey) error
+}
+
+// Client runs the initiating side of the handshake over rw and returns the
+// secured connection. The peer must call Server.
+func Client(rw msgio.ReadWriter, cfg *Config) (*Conn, error) {
+	return handshake(rw, cfg, true)
+}
+
+// Server runs the responding side of the handshake over rw and returns the
+// secured connection. The peer must call Client.
+func Server(rw msgio.ReadWriter, cfg *Config) (*Conn, error) {
+	return handshake(rw, cfg, false)
+}
+
+func handshake(rw msgio.ReadWriter, cfg *Config, initiator bool) (*Conn, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	local := eph.PublicKey().Bytes()
+
+	// The initiator always speaks first so that the exchange also works
+	// over unbuffered transports such as net.Pipe.
+	var remote []byte
+	if initiator {
+		if err := rw.WriteMsg(local); err != nil {
+			return nil, err
+		}
+		if remote, err = readEphemeral(rw); err != nil {
+			return nil, err
+		}
+	} else {
+		if remote, err = readEphemeral(rw); err != nil {
+			return nil, err
+		}
+		if err := rw.WriteMsg(local); err != nil {
+			return nil, err
+		}
+	}
+
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, ErrBadHandshake
+	}
+	secret, err := eph.ECDH(remoteKey)
+	if err != nil {
+		return nil, err
+	}
+
+	initKey, respKey := local, remote
+	if !initiator {
+		initKey, respKey = remote, local
+	}
+	h := sha256.New()
+	h.Write([]byte(protocolID))
+	h.Write(initKey)
+	h.Write(respKey)
+	transcript := h.Sum(nil)
+
+	keys, err := hkdf.Key(sha256.New, secret, transcript, protocolID+" keys", 64)
+	if err != nil {
+		return nil, err
+	}
+	i2r, r2i := keys[:32], keys[32:]
+
+	var conn *Conn
+	if initiator {
+		conn, err = newConn(rw, r2i, i2r)
+	} else {
+		conn, err = newConn(rw, i2r, r2i)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The static key exchange already runs over the secured channel so
+	// identities are not revealed to passive observers.
+	if initiator {
+		if err := writeAuth(conn, cfg, transcript, initiator); err != nil {
+			return nil, err
+		}
+		if err := readAuth(conn, cfg, transcript, !initiator); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := readAuth(conn, cfg, transcript, !initiator); err != nil {
+			return nil, err
+		}
+		if err := writeAuth(conn, cfg, transcript, initiator); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func readEphemeral(rw msgio.ReadWriter) ([]byte, error) {
+	msg, err := rw.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	defer rw.ReleaseMsg(msg)
+
+	if len(msg) != 32 {
+		return nil, ErrBadHandshake
+	}
+	return append([]byte(nil), msg...), nil
+}
+
+// authPayload is what a static key signs. It binds the signature to both
+// ephemeral keys and to the signer's role so it can't be replayed or
+// reflected.
+func authPayload(transcript []byte, initiator bool) []byte {
+	role := byte('r')
+	if initiator {
+		role = 'i'
+	}
+	p := make([]byte, 0, len(protocolID)+1+len(transcript))
+	p = append(p, protocolID...)
+	p = append(p, role)
+	return append(p, transcript...)
+}
+
+func writeAuth(conn *Conn, cfg *Config, transcript []byte, initiator bool) error {
+	if cfg.PrivateKey == nil {
+		return conn.WriteMsg(nil)
+	}
+	pub := cfg.PrivateKey.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(cfg.PrivateKey, authPayload(transcript, initiator))
+
+	msg := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize)
+	msg = append(msg, pub...)
+	msg = append(msg, sig...)
+	return conn.WriteMsg(msg)
+}
+
+func readAuth(conn *Conn, cfg *Config, transcript []byte, initiator bool) error {
+	msg, err := conn.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer conn.ReleaseMsg(msg)
+
+	switch len(msg) {
+	case 0:
+		if cfg.VerifyPeer != nil {
+			return ErrPeerUnauthenticated
+		}
+		return nil
+	case ed25519.PublicKeySize + ed25519.SignatureSize:
+	default:
+		return ErrBadHandshake
+	}
+
+	pub := ed25519.PublicKey(append([]byte(nil), msg[:ed25519.PublicKeySize]...))
+	if !ed25519.Verify(pub, authPayload(transcript, initiator), msg[ed25519.PublicKeySize:]) {
+		return ErrBadSignature
+	}
+	if cfg.VerifyPeer != nil {
+		if err := cfg.VerifyPeer(pub); err != nil {
+			return err
+		}
+	}
+	conn.remote = pub
+	return nil
+}
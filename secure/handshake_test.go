@@ -0,0 +1,208 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	msgio "github.com/libp2p/go-msgio"
+)
+
+type result struct {
+	conn *Conn
+	err  error
+}
+
+func pipeHandshake(t *testing.T, ccfg, scfg *Config) (client, server result, cc, sc net.Conn) {
+	cc, sc = net.Pipe()
+	done := make(chan result)
+	go func() {
+		conn, err := Server(msgio.NewReadWriter(sc), scfg)
+		if err != nil {
+			// unblock the client
+			sc.Close()
+		}
+		done <- result{conn, err}
+	}()
+	conn, err := Client(msgio.NewReadWriter(cc), ccfg)
+	if err != nil {
+		cc.Close()
+	}
+	client = result{conn, err}
+	server = <-done
+	t.Cleanup(func() {
+		cc.Close()
+		sc.Close()
+	})
+	return client, server, cc, sc
+}
+
+func TestHandshakeAnonymous(t *testing.T) {
+	client, server, _, _ := pipeHandshake(t, nil, nil)
+	if client.err != nil || server.err != nil {
+		t.Fatal(client.err, server.err)
+	}
+	if client.conn.RemotePublicKey() != nil || server.conn.RemotePublicKey() != nil {
+		t.Fatal("expected no remote keys")
+	}
+
+	go func() {
+		for _, m := range []string{"hello", "", "world"} {
+			if err := client.conn.WriteMsg([]byte(m)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for _, m := range []string{"hello", "", "world"} {
+		msg, err := server.conn.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Fatalf("expected %q, got %q", m, msg)
+		}
+		server.conn.ReleaseMsg(msg)
+	}
+}
+
+func TestHandshakeMutual(t *testing.T) {
+	cpub, cpriv, _ := ed25519.GenerateKey(rand.Reader)
+	spub, spriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	client, server, _, _ := pipeHandshake(t,
+		&Config{PrivateKey: cpriv, VerifyPeer: func(k ed25519.PublicKey) error {
+			if !k.Equal(spub) {
+				return errors.New("unexpected server key")
+			}
+			return nil
+		}},
+		&Config{PrivateKey: spriv, VerifyPeer: func(k ed25519.PublicKey) error {
+			if !k.Equal(cpub) {
+				return errors.New("unexpected client key")
+			}
+			return nil
+		}},
+	)
+	if client.err != nil || server.err != nil {
+		t.Fatal(client.err, server.err)
+	}
+	if !client.conn.RemotePublicKey().Equal(spub) || !server.conn.RemotePublicKey().Equal(cpub) {
+		t.Fatal("wrong remote keys")
+	}
+
+	go server.conn.WriteMsg([]byte("pong"))
+	buf := make([]byte, 10)
+	n, err := client.conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Fatalf("expected pong, got %q", buf[:n])
+	}
+}
+
+func TestHandshakeRejectsUnknownKey(t *testing.T) {
+	_, spriv, _ := ed25519.GenerateKey(rand.Reader)
+	errReject := errors.New("rejected")
+
+	client, _, _, _ := pipeHandshake(t,
+		&Config{VerifyPeer: func(ed25519.PublicKey) error { return errReject }},
+		&Config{PrivateKey: spriv},
+	)
+	if client.err != errReject {
+		t.Fatalf("expected rejection, got %v", client.err)
+	}
+}
+
+func TestHandshakeRequiresPeerKey(t *testing.T) {
+	_, cpriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	_, server, _, _ := pipeHandshake(t,
+		&Config{PrivateKey: cpriv},
+		&Config{VerifyPeer: func(ed25519.PublicKey) error { return nil }},
+	)
+	if server.err != nil {
+		t.Fatal(server.err)
+	}
+
+	client, server, _, _ := pipeHandshake(t,
+		nil,
+		&Config{VerifyPeer: func(ed25519.PublicKey) error { return nil }},
+	)
+	if server.err != ErrPeerUnauthenticated {
+		t.Fatalf("expected ErrPeerUnauthenticated, got %v", server.err)
+	}
+	if client.err == nil {
+		t.Fatal("expected client handshake to fail")
+	}
+}
+
+func TestTamperedMessage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	key := make([]byte, 32)
+	w, err := newConn(msgio.NewReadWriter(buf), key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newConn(msgio.NewReadWriter(buf), key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMsg([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Bytes()[8] ^= 0xff
+	if _, err := r.ReadMsg(); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestReplayedMessage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	key := make([]byte, 32)
+	w, _ := newConn(msgio.NewReadWriter(buf), key, key)
+	r, _ := newConn(msgio.NewReadWriter(buf), key, key)
+
+	if err := w.WriteMsg([]byte("once")); err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte(nil), buf.Bytes()...)
+	buf.Write(frame)
+
+	if _, err := r.ReadMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadMsg(); err != ErrDecrypt {
+		t.Fatalf("expected replay to fail, got %v", err)
+	}
+}
+
+func TestShortBuffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	key := make([]byte, 32)
+	w, _ := newConn(msgio.NewReadWriter(buf), key, key)
+	r, _ := newConn(msgio.NewReadWriter(buf), key, key)
+
+	if err := w.WriteMsg([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 2)); err != io.ErrShortBuffer {
+		t.Fatalf("expected ErrShortBuffer, got %v", err)
+	}
+	if n, err := r.NextMsgLen(); err != nil || n != 5 {
+		t.Fatalf("expected 5, got %d, %v", n, err)
+	}
+	msg := make([]byte, 10)
+	n, err := r.Read(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q", msg[:n])
+	}
+}
@@ -0,0 +1,153 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// SpillReader is a Reader for the framing of NewWriter that can also read
+// messages too large to keep in memory, by spilling them to temporary files.
+//
+// ReadMsg returns ErrMsgTooLarge for messages over the memory threshold,
+// without consuming them; ReadStream returns any message, spilling those
+// over the threshold to disk. The spill files of a reader together never
+// hold more than its disk limit.
+type SpillReader struct {
+	*reader
+
+	dir     string
+	maxDisk int64
+	disk    atomic.Int64 // bytes held by open spill files
+}
+
+// NewSpillReader wraps an io.Reader with a SpillReader keeping messages of
+// up to memoryThreshold bytes in memory, and spilling larger ones to
+// temporary files in dir, up to diskLimit bytes in total. If dir is empty,
+// the default directory for temporary files is used.
+func NewSpillReader(r io.Reader, memoryThreshold int, diskLimit int64, dir string) *SpillReader {
+	return NewSpillReaderWithPool(r, memoryThreshold, diskLimit, dir, pool.GlobalPool)
+}
+
+// NewSpillReaderWithPool is the same as NewSpillReader but allows one to
+// specify a buffer pool.
+func NewSpillReaderWithPool(r io.Reader, memoryThreshold int, diskLimit int64, dir string, p *pool.BufferPool) *SpillReader {
+	return &SpillReader{
+		reader:  NewReaderSizeWithPool(r, memoryThreshold, p).(*reader),
+		dir:     dir,
+		maxDisk: diskLimit,
+	}
+}
+
+// DiskUsage returns the number of bytes held by spill files that haven't
+// been closed yet.
+func (s *SpillReader) DiskUsage() int64 {
+	return s.disk.Load()
+}
+
+// ReadStream reads the next message. Messages up to the memory threshold are
+// read into a pooled buffer, and larger ones into a temporary file. Either
+// way, the caller must close the returned stream, which releases the buffer
+// or removes the file.
+//
+// A message that would take the spill files over the disk limit is skipped,
+// and ReadStream returns ErrMsgTooLarge.
+func (s *SpillReader) ReadStream() (io.ReadSeekCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	length, err := s.nextMsgLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if length <= s.max {
+		msg := s.pool.Get(length)
+		read, err := io.ReadFull(s.R, msg)
+		if read < length {
+			s.next = length - read // we only partially consumed the message.
+			s.pool.Put(msg)
+			return nil, err
+		}
+		s.next = -1
+		return &memoryStream{Reader: bytes.NewReader(msg), msg: msg, pool: s.pool}, nil
+	}
+
+	size := int64(length)
+	if s.disk.Add(size) > s.maxDisk {
+		s.disk.Add(-size)
+		read, err := io.CopyN(io.Discard, s.R, size)
+		if read < size {
+			s.next = length - int(read)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		s.next = -1
+		return nil, ErrMsgTooLarge
+	}
+
+	f, err := os.CreateTemp(s.dir, "msgio-spill-*")
+	if err != nil {
+		s.disk.Add(-size)
+		return nil, err
+	}
+	spill := &spillFile{File: f, size: size, disk: &s.disk}
+	read, err := io.CopyN(f, s.R, size)
+	if read < size {
+		s.next = length - int(read)
+		spill.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	s.next = -1
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		spill.Close()
+		return nil, err
+	}
+	return spill, nil
+}
+
+// memoryStream is a message read into a pooled buffer.
+type memoryStream struct {
+	*bytes.Reader
+	msg  []byte
+	pool *pool.BufferPool
+	once sync.Once
+}
+
+func (m *memoryStream) Close() error {
+	m.once.Do(func() {
+		m.Reader.Reset(nil)
+		m.pool.Put(m.msg)
+	})
+	return nil
+}
+
+// spillFile is a message spilled to a temporary file, which is removed on
+// Close.
+type spillFile struct {
+	*os.File
+	size int64
+	disk *atomic.Int64
+	once sync.Once
+}
+
+func (f *spillFile) Close() error {
+	err := os.ErrClosed
+	f.once.Do(func() {
+		err = f.File.Close()
+		if rerr := os.Remove(f.Name()); err == nil {
+			err = rerr
+		}
+		f.disk.Add(-f.size)
+	})
+	return err
+}
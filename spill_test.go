@@ -0,0 +1,106 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readStream(t *testing.T, r *SpillReader) (string, io.ReadSeekCloser) {
+	t.Helper()
+	stream, err := r.ReadStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), stream
+}
+
+func TestSpillReader(t *testing.T) {
+	dir := t.TempDir()
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	large := strings.Repeat("x", 100)
+	for _, msg := range []string{"small", large, "", large} {
+		if err := w.WriteMsg([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewSpillReader(buf, 10, 150, dir)
+	msg, stream := readStream(t, r)
+	if msg != "small" {
+		t.Fatalf("expected small, got %q", msg)
+	}
+	stream.Close()
+
+	// ReadMsg leaves large messages to ReadStream.
+	if _, err := r.ReadMsg(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	msg, spilled := readStream(t, r)
+	if msg != large {
+		t.Fatalf("expected the large message, got %q", msg)
+	}
+	if _, ok := spilled.(*spillFile); !ok {
+		t.Fatalf("expected a spill file, got %T", spilled)
+	}
+	if r.DiskUsage() != 100 {
+		t.Fatalf("expected 100 bytes on disk, got %d", r.DiskUsage())
+	}
+	if _, err := spilled.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := io.ReadAll(spilled); len(rest) != 90 {
+		t.Fatalf("expected 90 bytes after seeking, got %d", len(rest))
+	}
+
+	msg, stream = readStream(t, r)
+	if msg != "" {
+		t.Fatalf("expected an empty message, got %q", msg)
+	}
+	stream.Close()
+
+	// The second large message doesn't fit on disk with the first one.
+	if _, err := r.ReadStream(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	if _, err := r.ReadStream(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	if err := spilled.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r.DiskUsage() != 0 {
+		t.Fatalf("expected nothing on disk, got %d bytes", r.DiskUsage())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected spill files to be removed, found %d", len(files))
+	}
+}
+
+func TestSpillReaderTruncated(t *testing.T) {
+	dir := t.TempDir()
+	buf := new(bytes.Buffer)
+	if err := NewWriter(buf).WriteMsg(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	buf.Truncate(50)
+
+	r := NewSpillReader(buf, 10, 1000, dir)
+	if _, err := r.ReadStream(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+	if r.DiskUsage() != 0 {
+		t.Fatalf("expected nothing on disk, got %d bytes", r.DiskUsage())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected spill files to be removed, found %d", len(files))
+	}
+}
@@ -0,0 +1,325 @@
+package msgio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/multiformats/go-varint"
+)
+
+// ErrBadCapture is returned when replaying something that isn't a capture
+// written by Capture, or a corrupt one.
+var ErrBadCapture = errors.New("invalid capture")
+
+// captureMagic starts every capture, followed by the format version.
+const captureMagic = "msgiocap"
+
+const captureVersion = 1
+
+// recordOverhead is the largest record header.
+const recordOverhead = 1 + 2*varint.MaxLenUvarint63
+
+// Direction tells whether a captured message was read or written.
+type Direction byte
+
+const (
+	DirRead Direction = iota
+	DirWrite
+)
+
+// Record is a single captured message.
+type Record struct {
+	Conn uint64        // connection the message was seen on
+	Dir  Direction     // whether it was read or written
+	Time time.Duration // monotonic time since the capture started
+	Msg  []byte
+}
+
+// Capture records the messages of any number of tapped connections to a
+// single sink. Each record is a varint framed message holding the
+// direction, a uvarint connection ID, a uvarint timestamp in nanoseconds
+// and the payload.
+//
+// Failing to write to the sink never fails the tapped connection; the first
+// such error is reported by Err and stops further recording.
+type Capture struct {
+	w     WriteCloser
+	start time.Time
+
+	lock   sync.Mutex
+	nextID uint64
+	header bool
+	err    error
+}
+
+// NewCapture starts a capture writing to sink.
+func NewCapture(sink io.Writer) *Capture {
+	return &Capture{w: NewVarintWriter(sink), start: time.Now()}
+}
+
+// Tap returns rw with every message read from or written to it recorded
+// under a new connection ID.
+func (c *Capture) Tap(rw ReadWriter) ReadWriteCloser {
+	c.lock.Lock()
+	id := c.nextID
+	c.nextID++
+	c.lock.Unlock()
+	return &tap{rw: rw, capture: c, id: id}
+}
+
+// Err returns the first error writing to the sink, if any.
+func (c *Capture) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *Capture) record(id uint64, dir Direction, msg []byte) {
+	now := time.Since(c.start)
+
+	buf := pool.Get(1 + 2*varint.MaxLenUvarint63 + len(msg))
+	defer pool.Put(buf)
+	buf[0] = byte(dir)
+	n := 1
+	n += varint.PutUvarint(buf[n:], id)
+	n += varint.PutUvarint(buf[n:], uint64(now))
+	n += copy(buf[n:], msg)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	if !c.header {
+		c.header = true
+		if c.err = c.w.WriteMsg(append([]byte(captureMagic), captureVersion)); c.err != nil {
+			return
+		}
+	}
+	c.err = c.w.WriteMsg(buf[:n])
+}
+
+// Tap is a shorthand for NewCapture(sink).Tap(rw).
+func Tap(rw ReadWriter, sink io.Writer) ReadWriteCloser {
+	return NewCapture(sink).Tap(rw)
+}
+
+type tap struct {
+	rw      ReadWriter
+	capture *Capture
+	id      uint64
+}
+
+func (t *tap) Read(buf []byte) (int, error) {
+	n, err := t.rw.Read(buf)
+	if err == nil {
+		t.capture.record(t.id, DirRead, buf[:n])
+	}
+	return n, err
+}
+
+func (t *tap) ReadMsg() ([]byte, error) {
+	msg, err := t.rw.ReadMsg()
+	if err == nil {
+		t.capture.record(t.id, DirRead, msg)
+	}
+	return msg, err
+}
+
+func (t *tap) ReleaseMsg(msg []byte) {
+	t.rw.ReleaseMsg(msg)
+}
+
+func (t *tap) NextMsgLen() (int, error) {
+	return t.rw.NextMsgLen()
+}
+
+func (t *tap) Write(msg []byte) (int, error) {
+	err := t.WriteMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (t *tap) WriteMsg(msg []byte) error {
+	err := t.rw.WriteMsg(msg)
+	if err == nil {
+		t.capture.record(t.id, DirWrite, msg)
+	}
+	return err
+}
+
+func (t *tap) Close() error {
+	if c, ok := t.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Replay is a Reader playing back a capture.
+type Replay struct {
+	R     ReadCloser
+	speed float64
+
+	// Filter, if set, selects the records to play back. It must be set
+	// before the first read.
+	Filter func(*Record) bool
+
+	lock   sync.Mutex
+	header bool
+	base   time.Time     // when playback started
+	first  time.Duration // timestamp of the first record played back
+	next   *Record       // a record peeked by NextMsgLen or a short Read
+}
+
+// NewReplay plays back the capture read from r. With a speed of 1 records
+// are returned with their original timing, with a speed of 2 twice as fast,
+// and so on; a speed of 0 returns them as fast as possible.
+func NewReplay(r io.Reader, speed float64) *Replay {
+	return NewReplaySize(r, speed, defaultMaxSize)
+}
+
+// NewReplaySize is equivalent to NewReplay but allows one to specify a max
+// message size.
+func NewReplaySize(r io.Reader, speed float64, maxMessageSize int) *Replay {
+	return &Replay{R: NewVarintReaderSize(r, maxMessageSize+recordOverhead), speed: speed}
+}
+
+// ReadRecord returns the next record. Its Msg should be handed back with
+// ReleaseMsg once done with.
+func (p *Replay) ReadRecord() (*Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.recv()
+}
+
+// recv must be called with p.lock held.
+func (p *Replay) recv() (*Record, error) {
+	if p.next != nil {
+		rec := p.next
+		p.next = nil
+		return rec, nil
+	}
+
+	if !p.header {
+		msg, err := p.R.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		valid := bytes.Equal(msg, append([]byte(captureMagic), captureVersion))
+		p.R.ReleaseMsg(msg)
+		if !valid {
+			return nil, ErrBadCapture
+		}
+		p.header = true
+	}
+
+	for {
+		msg, err := p.R.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		rec, err := parseRecord(msg)
+		if err != nil {
+			p.R.ReleaseMsg(msg)
+			return nil, err
+		}
+		if p.Filter != nil && !p.Filter(rec) {
+			p.R.ReleaseMsg(msg)
+			continue
+		}
+		p.wait(rec.Time)
+		return rec, nil
+	}
+}
+
+func parseRecord(msg []byte) (*Record, error) {
+	if len(msg) < 1 {
+		return nil, ErrBadCapture
+	}
+	rec := &Record{Dir: Direction(msg[0])}
+	rest := msg[1:]
+	id, n, err := varint.FromUvarint(rest)
+	if err != nil {
+		return nil, ErrBadCapture
+	}
+	rest = rest[n:]
+	ts, n, err := varint.FromUvarint(rest)
+	if err != nil {
+		return nil, ErrBadCapture
+	}
+	rec.Conn = id
+	rec.Time = time.Duration(ts)
+
+	// shift the payload to the start of the pooled buffer so it can be
+	// released as is
+	l := copy(msg, rest[n:])
+	rec.Msg = msg[:l]
+	return rec, nil
+}
+
+// wait sleeps until a record captured at ts is due.
+func (p *Replay) wait(ts time.Duration) {
+	if p.speed <= 0 {
+		return
+	}
+	if p.base.IsZero() {
+		p.base = time.Now()
+		p.first = ts
+		return
+	}
+	due := p.base.Add(time.Duration(float64(ts-p.first) / p.speed))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (p *Replay) ReadMsg() ([]byte, error) {
+	rec, err := p.ReadRecord()
+	if err != nil {
+		return nil, err
+	}
+	return rec.Msg, nil
+}
+
+func (p *Replay) Read(buf []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	rec, err := p.recv()
+	if err != nil {
+		return 0, err
+	}
+	if len(rec.Msg) > len(buf) {
+		p.next = rec
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(buf, rec.Msg)
+	p.R.ReleaseMsg(rec.Msg)
+	return n, nil
+}
+
+func (p *Replay) NextMsgLen() (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	rec, err := p.recv()
+	if err != nil {
+		return 0, err
+	}
+	p.next = rec
+	return len(rec.Msg), nil
+}
+
+func (p *Replay) ReleaseMsg(msg []byte) {
+	p.R.ReleaseMsg(msg)
+}
+
+func (p *Replay) Close() error {
+	return p.R.Close()
+}
@@ -0,0 +1,143 @@
+package msgio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTapReplay(t *testing.T) {
+	conn := new(bytes.Buffer)
+	capture := new(bytes.Buffer)
+	c := NewCapture(capture)
+	rw1 := c.Tap(NewReadWriter(conn))
+	rw2 := c.Tap(NewReadWriter(conn))
+
+	if err := rw1.WriteMsg([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	msg, err := rw2.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ping" {
+		t.Fatalf("expected ping, got %q", msg)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewReplay(bytes.NewReader(capture.Bytes()), 0)
+	rec, err := p.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Conn != 0 || rec.Dir != DirWrite || string(rec.Msg) != "ping" {
+		t.Fatalf("unexpected first record %+v", rec)
+	}
+	first := rec.Time
+	p.ReleaseMsg(rec.Msg)
+
+	rec, err = p.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Conn != 1 || rec.Dir != DirRead || string(rec.Msg) != "ping" {
+		t.Fatalf("unexpected second record %+v", rec)
+	}
+	if rec.Time-first < 20*time.Millisecond {
+		t.Fatalf("timestamps too close: %s", rec.Time-first)
+	}
+	if _, err := p.ReadRecord(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	conn := new(bytes.Buffer)
+	capture := new(bytes.Buffer)
+	rw := Tap(NewReadWriter(conn), capture)
+	for i := 0; i < 3; i++ {
+		rw.WriteMsg([]byte{byte(i)})
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, tc := range []struct {
+		speed    float64
+		min, max time.Duration
+	}{
+		{1, 35 * time.Millisecond, time.Second},
+		{4, 5 * time.Millisecond, 35 * time.Millisecond},
+	} {
+		p := NewReplay(bytes.NewReader(capture.Bytes()), tc.speed)
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			msg, err := p.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg[0] != byte(i) {
+				t.Fatalf("expected %d, got %d", i, msg[0])
+			}
+		}
+		if d := time.Since(start); d < tc.min || d > tc.max {
+			t.Fatalf("speed %v: replay took %s", tc.speed, d)
+		}
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	conn := new(bytes.Buffer)
+	capture := new(bytes.Buffer)
+	rw := Tap(NewReadWriter(conn), capture)
+	rw.WriteMsg([]byte("out"))
+	rw.ReadMsg()
+
+	p := NewReplay(bytes.NewReader(capture.Bytes()), 0)
+	p.Filter = func(r *Record) bool { return r.Dir == DirRead }
+	buf := make([]byte, 10)
+	n, err := p.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "out" {
+		t.Fatalf("expected out, got %q", buf[:n])
+	}
+	if _, err := p.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReplayBadCapture(t *testing.T) {
+	buf := new(bytes.Buffer)
+	NewVarintWriter(buf).WriteMsg([]byte("not a capture"))
+	if _, err := NewReplay(buf, 0).ReadMsg(); err != ErrBadCapture {
+		t.Fatalf("expected ErrBadCapture, got %v", err)
+	}
+}
+
+func TestReplayMaxSize(t *testing.T) {
+	capture := new(bytes.Buffer)
+	rw := Tap(NewReadWriter(new(bytes.Buffer)), capture)
+	large := bytes.Repeat([]byte("x"), defaultMaxSize)
+	if err := rw.WriteMsg(large); err != nil {
+		t.Fatal(err)
+	}
+	rw.WriteMsg([]byte("0123456789a"))
+
+	p := NewReplay(bytes.NewReader(capture.Bytes()), 0)
+	msg, err := p.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, large) {
+		t.Fatal("replayed the wrong message")
+	}
+
+	p = NewReplaySize(bytes.NewReader(capture.Bytes()), 0, 10)
+	if _, err := p.ReadMsg(); err != ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+}